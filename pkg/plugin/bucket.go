@@ -0,0 +1,170 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	// time zones are resolved without relying on the zoneinfo of the host
+	_ "time/tzdata"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+)
+
+var bucketIntervalRegex = regexp.MustCompile(`^(\d+)(ms|s|m|h|d|w|M|y)$`)
+
+// bucketIntervalUnits maps the interval units onto DuckDB interval units
+var bucketIntervalUnits = map[string]string{
+	"ms": "milliseconds",
+	"s":  "seconds",
+	"m":  "minutes",
+	"h":  "hours",
+	"d":  "days",
+	"w":  "weeks",
+	"M":  "months",
+	"y":  "years",
+}
+
+// timeBucket is a parsed $__timeGroup call. Buckets of fixed length in UTC are computed on epoch seconds as they
+// always were. Calendar units (weeks, months, years), a time zone, an origin or an offset use DuckDB's time_bucket,
+// which aligns weeks to Monday and months and years to their first day.
+type timeBucket struct {
+	column   string
+	interval string
+	unit     string
+	duration time.Duration
+	fill     string
+	timezone string
+	origin   string
+	offset   string
+}
+
+// parseTimeBucket parses the arguments of $__timeGroup: the column, the interval and, in any order, a fill value,
+// a quoted time zone or tz for the time zone of the datasource, origin='<timestamp>' and offset='<interval>'.
+func parseTimeBucket(args []string, datasourceTimezone string) (*timeBucket, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("macro $__timeGroup needs time column and interval and optional fill value")
+	}
+
+	interval := strings.Trim(args[1], `'`)
+	duration, err := gtime.ParseInterval(interval)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing interval %v", args[1])
+	}
+	b := &timeBucket{column: args[0], interval: interval, duration: duration}
+	if match := bucketIntervalRegex.FindStringSubmatch(interval); match != nil {
+		b.unit = match[2]
+	}
+
+	for _, arg := range args[2:] {
+		if key, value, ok := strings.Cut(arg, "="); ok {
+			value = strings.Trim(strings.TrimSpace(value), `'`)
+			switch strings.TrimSpace(key) {
+			case "origin":
+				if _, err := time.Parse(time.DateOnly, value); err != nil {
+					if _, err := time.Parse(time.DateTime, value); err != nil {
+						return nil, fmt.Errorf("error parsing origin %v", value)
+					}
+				}
+				b.origin = value
+			case "offset":
+				if _, err := bucketDuckDBInterval(strings.TrimPrefix(value, "-")); err != nil {
+					return nil, fmt.Errorf("error parsing offset %v", value)
+				}
+				b.offset = value
+			default:
+				return nil, fmt.Errorf("unknown $__timeGroup argument %v", key)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(arg, "'") {
+			timezone := strings.Trim(arg, `'`)
+			if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+				return nil, fmt.Errorf("unknown time zone %v", timezone)
+			}
+			b.timezone = timezone
+			continue
+		}
+		if arg == "tz" {
+			if datasourceTimezone == "" {
+				return nil, fmt.Errorf("the tz argument of $__timeGroup needs the time zone setting of the datasource")
+			}
+			b.timezone = datasourceTimezone
+			continue
+		}
+		b.fill = arg
+	}
+
+	if b.timezone == "UTC" {
+		b.timezone = ""
+	}
+	if b.origin != "" && (b.offset != "" || b.timezone != "") {
+		return nil, fmt.Errorf("the origin of $__timeGroup can not be combined with an offset or a time zone")
+	}
+	if b.fill != "" && b.calendar() {
+		// see queryFills
+		return nil, fmt.Errorf("the fill value of $__timeGroup can not be combined with calendar units, a time zone, an origin or an offset")
+	}
+	return b, nil
+}
+
+// calendar reports whether the bucket needs time_bucket instead of fixed epoch seconds
+func (b *timeBucket) calendar() bool {
+	return b.unit == "w" || b.unit == "M" || b.unit == "y" || b.timezone != "" || b.origin != "" || b.offset != ""
+}
+
+// queryFills reports whether the fill setting of the query is on. Missing points are filled on a grid of fixed
+// intervals from the epoch.
+func queryFills(query *backend.DataQuery) bool {
+	var settings struct {
+		Fill bool `json:"fill"`
+	}
+	return json.Unmarshal(query.JSON, &settings) == nil && settings.Fill
+}
+
+// bucketDuckDBInterval renders an interval such as 15m as a DuckDB interval literal
+func bucketDuckDBInterval(interval string) (string, error) {
+	match := bucketIntervalRegex.FindStringSubmatch(interval)
+	if match == nil {
+		return "", fmt.Errorf("invalid interval %v", interval)
+	}
+	return fmt.Sprintf("INTERVAL '%s %s'", match[1], bucketIntervalUnits[match[2]]), nil
+}
+
+// sql renders the time_bucket call. Time zones need the icu extension.
+func (b *timeBucket) sql() (string, error) {
+	width, err := bucketDuckDBInterval(b.interval)
+	if err != nil {
+		// intervals such as 1h30m are not a single unit, they are fixed lengths
+		width = fmt.Sprintf("INTERVAL '%s milliseconds'", strconv.FormatInt(b.duration.Milliseconds(), 10))
+	}
+
+	column := b.column
+	var offset string
+	if b.offset != "" {
+		if offset, err = bucketDuckDBInterval(strings.TrimPrefix(b.offset, "-")); err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(b.offset, "-") {
+			offset = "-" + offset
+		}
+	}
+
+	switch {
+	case b.timezone != "" && offset != "":
+		// the time zone variant takes no offset, the column is shifted instead
+		return fmt.Sprintf("time_bucket(%s, CAST(%s AS TIMESTAMPTZ) - %s, '%s') + %s", width, column, offset, b.timezone, offset), nil
+	case b.timezone != "":
+		return fmt.Sprintf("time_bucket(%s, CAST(%s AS TIMESTAMPTZ), '%s')", width, column, b.timezone), nil
+	case offset != "":
+		return fmt.Sprintf("time_bucket(%s, %s, %s)", width, column, offset), nil
+	case b.origin != "":
+		return fmt.Sprintf("time_bucket(%s, %s, TIMESTAMP '%s')", width, column, b.origin), nil
+	default:
+		return fmt.Sprintf("time_bucket(%s, %s)", width, column), nil
+	}
+}
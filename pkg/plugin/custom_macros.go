@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/omaha/duckdb/pkg/plugin/sqleng"
+)
+
+// builtinMacroNames are the macros of the macro engine and the global substitutions of sqleng.Interpolate
+var builtinMacroNames = []string{
+	"__time", "__timeEpoch", "__timeFilter", "__timeFrom", "__timeTo", "__timeGroup", "__timeGroupAlias",
+	"__timeFilterShifted", "__timeFromShifted", "__timeToShifted", "__rollupTable", "__histogram", "__snapshot",
+	"__unixEpochFilter", "__unixEpochNanoFilter", "__unixEpochNanoFrom", "__unixEpochNanoTo", "__unixEpochGroup",
+	"__unixEpochGroupAlias", "__interval", "__interval_ms", "__unixEpochFrom", "__unixEpochTo",
+}
+
+// maxCustomMacroDepth bounds the expansion of custom macros using each other
+const maxCustomMacroDepth = 10
+
+var customMacroNameRegex = regexp.MustCompile(`^[_a-zA-Z][_a-zA-Z0-9]*$`)
+
+// customMacroParamRegex matches the $param placeholders of a custom macro template
+var customMacroParamRegex = regexp.MustCompile(`\$([_a-zA-Z][_a-zA-Z0-9]*)`)
+
+// validateCustomMacros checks the custom macros of the datasource settings. Names must not shadow the built-in
+// macros or each other.
+func validateCustomMacros(macros []sqleng.CustomMacro) error {
+	seen := make(map[string]bool)
+	for _, macro := range macros {
+		name := strings.TrimPrefix(macro.Name, "$")
+		if !customMacroNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid custom macro name %q", macro.Name)
+		}
+		for _, builtin := range builtinMacroNames {
+			if strings.EqualFold(name, builtin) {
+				return fmt.Errorf("custom macro %q clashes with the built-in macro $%s", macro.Name, builtin)
+			}
+		}
+		if seen[name] {
+			return fmt.Errorf("custom macro %q is defined twice", macro.Name)
+		}
+		seen[name] = true
+
+		params := make(map[string]bool)
+		for _, param := range macro.Params {
+			if !customMacroNameRegex.MatchString(param) || params[param] {
+				return fmt.Errorf("invalid parameter %q of custom macro %q", param, macro.Name)
+			}
+			params[param] = true
+		}
+	}
+	return nil
+}
+
+// expandCustomMacro substitutes the arguments into the template. The result is interpolated again, so templates
+// can use the built-in macros and other custom macros.
+func (m *postgresMacroEngine) expandCustomMacro(query *backend.DataQuery, timeRange backend.TimeRange, macro sqleng.CustomMacro, args []string, depth int) (string, error) {
+	if depth >= maxCustomMacroDepth {
+		return "", fmt.Errorf("custom macro %q nests more than %d levels deep", macro.Name, maxCustomMacroDepth)
+	}
+	if len(args) == 1 && args[0] == "" {
+		args = nil
+	}
+	if len(args) != len(macro.Params) {
+		return "", fmt.Errorf("custom macro %q needs %d arguments, got %d", macro.Name, len(macro.Params), len(args))
+	}
+
+	values := make(map[string]string, len(args))
+	for i, param := range macro.Params {
+		values[param] = args[i]
+	}
+	sql := customMacroParamRegex.ReplaceAllStringFunc(macro.Template, func(placeholder string) string {
+		if value, ok := values[placeholder[1:]]; ok {
+			return value
+		}
+		return placeholder
+	})
+
+	sql = sqleng.Interpolate(*query, timeRange, "", sql)
+	return m.interpolate(query, timeRange, sql, depth+1)
+}
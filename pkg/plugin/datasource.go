@@ -37,6 +37,7 @@ import (
 var (
 	_ backend.QueryDataHandler      = (*sqleng.DataSourceHandler)(nil)
 	_ backend.CheckHealthHandler    = (*sqleng.DataSourceHandler)(nil)
+	_ backend.CallResourceHandler   = (*sqleng.DataSourceHandler)(nil)
 	_ instancemgmt.InstanceDisposer = (*sqleng.DataSourceHandler)(nil)
 )
 
@@ -424,6 +425,13 @@ func (s *Service) NewInstanceSettings() datasource.InstanceFactoryFunc {
 		if err != nil {
 			return nil, fmt.Errorf("error reading settings: %w", err)
 		}
+		if err := validateCustomMacros(jsonData.CustomMacros); err != nil {
+			return nil, fmt.Errorf("error reading settings: %w", err)
+		}
+		rollups, err := sqleng.ParseRollups(jsonData.Rollups)
+		if err != nil {
+			return nil, fmt.Errorf("error reading settings: %w", err)
+		}
 
 		database := jsonData.Database
 		if database == "" {
@@ -446,7 +454,7 @@ func (s *Service) NewInstanceSettings() datasource.InstanceFactoryFunc {
 			return nil, err
 		}
 
-		_, handler, err := newDuckDb(ctx, userFacingDefaultError, sqlCfg.RowLimit, dsInfo, logger, settings)
+		_, handler, err := newDuckDb(ctx, userFacingDefaultError, sqlCfg.RowLimit, dsInfo, rollups, logger, settings)
 
 		if err != nil {
 			logger.Error("Failed connecting to Postgres", "err", err)
@@ -500,7 +508,7 @@ func (s *Service) Dispose() {
 	// Clean up datasource instance resources.
 }
 
-func newDuckDb(ctx context.Context, userFacingDefaultError string, rowLimit int64, dsInfo sqleng.DataSourceInfo, logger log.Logger, settings backend.DataSourceInstanceSettings) (*sql.DB, *sqleng.DataSourceHandler, error) {
+func newDuckDb(ctx context.Context, userFacingDefaultError string, rowLimit int64, dsInfo sqleng.DataSourceInfo, rollups map[string][]sqleng.Rollup, logger log.Logger, settings backend.DataSourceInstanceSettings) (*sql.DB, *sqleng.DataSourceHandler, error) {
 	//proxyClient, err := settings.ProxyClient(ctx)
 	//if err != nil {
 	//	logger.Error("postgres proxy creation failed", "error", err)
@@ -509,14 +517,14 @@ func newDuckDb(ctx context.Context, userFacingDefaultError string, rowLimit int6
 
 	config := sqleng.DataPluginConfiguration{
 		DSInfo:            dsInfo,
-		MetricColumnTypes: []string{"UNKNOWN", "TEXT", "VARCHAR", "CHAR"},
+		MetricColumnTypes: []string{"UNKNOWN", "TEXT", "VARCHAR", "CHAR", "ENUM"},
 		RowLimit:          rowLimit,
 	}
 
 	queryResultTransformer := duckDbQueryResultTransformer{}
 
 	handler, err := sqleng.NewQueryDataHandler(userFacingDefaultError, config, &queryResultTransformer,
-		newPostgresMacroEngine(dsInfo.JsonData.Timescaledb),
+		newPostgresMacroEngine(dsInfo.JsonData.Timescaledb, dsInfo.JsonData.Timezone, dsInfo.JsonData.CustomMacros, rollups),
 		logger)
 	if err != nil {
 		logger.Error("Failed connecting to DuckDB", "err", err)
@@ -5,63 +5,69 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
 	"github.com/omaha/duckdb/pkg/plugin/sqleng"
-	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
-const rsIdentifier = `([_a-zA-Z0-9]+)`
-const sExpr = `\$` + rsIdentifier + `\(([^\)]*)\)`
-
 type postgresMacroEngine struct {
 	*sqleng.SQLMacroEngineBase
 	timescaledb bool
+	// timezone is the time zone of $__timeGroup(…, tz), empty for none
+	timezone string
+	// customMacros are the macros of the datasource settings by name, see validateCustomMacros
+	customMacros map[string]sqleng.CustomMacro
+	// rollups are the rollup tables of $__rollupTable by base table, see sqleng.ParseRollups
+	rollups map[string][]sqleng.Rollup
 }
 
-func newPostgresMacroEngine(timescaledb bool) sqleng.SQLMacroEngine {
+func newPostgresMacroEngine(timescaledb bool, timezone string, customMacros []sqleng.CustomMacro, rollups map[string][]sqleng.Rollup) sqleng.SQLMacroEngine {
+	// time zones Go does not know, such as "browser", fall back to UTC
+	if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+		timezone = ""
+	}
+	macros := make(map[string]sqleng.CustomMacro, len(customMacros))
+	for _, macro := range customMacros {
+		macros[strings.TrimPrefix(macro.Name, "$")] = macro
+	}
 	return &postgresMacroEngine{
 		SQLMacroEngineBase: sqleng.NewSQLMacroEngineBase(),
 		timescaledb:        timescaledb,
+		timezone:           timezone,
+		customMacros:       macros,
+		rollups:            rollups,
 	}
 }
 
 func (m *postgresMacroEngine) Interpolate(query *backend.DataQuery, timeRange backend.TimeRange, sql string) (string, error) {
-	// TODO: Handle error
-	rExp, _ := regexp.Compile(sExpr)
-	var macroError error
+	return m.interpolate(query, timeRange, sql, 0)
+}
 
-	sql = m.ReplaceAllStringSubmatchFunc(rExp, sql, func(groups []string) string {
+func (m *postgresMacroEngine) interpolate(query *backend.DataQuery, timeRange backend.TimeRange, sql string, depth int) (string, error) {
+	return m.ReplaceMacros(sql, func(call sqleng.MacroCall) (string, error) {
+		name := call.Name
 		// detect if $__timeGroup is supposed to add AS time for pre 5.3 compatibility
 		// if there is a ',' directly after the macro call $__timeGroup is probably used
 		// in the old way. Inside window function ORDER BY $__timeGroup will be followed
 		// by ')'
-		if groups[1] == "__timeGroup" {
-			if index := strings.Index(sql, groups[0]); index >= 0 {
-				index += len(groups[0])
-				// check for character after macro expression
-				if len(sql) > index && sql[index] == ',' {
-					groups[1] = "__timeGroupAlias"
-				}
-			}
+		if name == "__timeGroup" && len(sql) > call.End && sql[call.End] == ',' {
+			name = "__timeGroupAlias"
 		}
 
-		args := strings.Split(groups[2], ",")
-		for i, arg := range args {
-			args[i] = strings.Trim(arg, " ")
+		if macro, ok := m.customMacros[name]; ok {
+			return m.expandCustomMacro(query, timeRange, macro, call.Args, depth)
 		}
-		res, err := m.evaluateMacro(timeRange, query, groups[1], args)
-		if err != nil && macroError == nil {
-			macroError = err
-			return "macro_error()"
+
+		// the arguments of built-in macros may use custom macros, e.g. $__timeGroup($bucketColumn(), 1h)
+		args := make([]string, len(call.Args))
+		for i, arg := range call.Args {
+			var err error
+			if args[i], err = m.interpolate(query, timeRange, arg, depth); err != nil {
+				return "", err
+			}
 		}
-		return res
+		return m.evaluateMacro(timeRange, query, name, args)
 	})
-
-	if macroError != nil {
-		return "", macroError
-	}
-
-	return sql, nil
 }
 
 //nolint:gocyclo
@@ -87,21 +93,48 @@ func (m *postgresMacroEngine) evaluateMacro(timeRange backend.TimeRange, query *
 		return fmt.Sprintf("'%s'", timeRange.From.UTC().Format(time.RFC3339Nano)), nil
 	case "__timeTo":
 		return fmt.Sprintf("'%s'", timeRange.To.UTC().Format(time.RFC3339Nano)), nil
-	case "__timeGroup":
+	case "__timeFilterShifted":
 		if len(args) < 2 {
-			return "", fmt.Errorf("macro %v needs time column and interval and optional fill value", name)
+			return "", fmt.Errorf("macro %v needs time column and time shift", name)
 		}
-		interval, err := gtime.ParseInterval(strings.Trim(args[1], `'`))
+		shift, err := sqleng.ParseTimeShift(args[1])
 		if err != nil {
-			return "", fmt.Errorf("error parsing interval %v", args[1])
+			return "", err
 		}
-		if len(args) == 3 {
-			err := sqleng.SetupFillmode(query, interval, args[2])
+		return fmt.Sprintf("%s BETWEEN '%s' AND '%s'", args[0], timeRange.From.Add(-shift).UTC().Format(time.RFC3339Nano), timeRange.To.Add(-shift).UTC().Format(time.RFC3339Nano)), nil
+	case "__timeFromShifted", "__timeToShifted":
+		if len(args) == 0 || args[0] == "" {
+			return "", fmt.Errorf("missing time shift argument for macro %v", name)
+		}
+		shift, err := sqleng.ParseTimeShift(args[0])
+		if err != nil {
+			return "", err
+		}
+		t := timeRange.From
+		if name == "__timeToShifted" {
+			t = timeRange.To
+		}
+		return fmt.Sprintf("'%s'", t.Add(-shift).UTC().Format(time.RFC3339Nano)), nil
+	case "__timeGroup":
+		bucket, err := parseTimeBucket(args, m.timezone)
+		if err != nil {
+			return "", err
+		}
+		interval := bucket.duration
+		if bucket.fill != "" {
+			err := sqleng.SetupFillmode(query, interval, bucket.fill)
 			if err != nil {
 				return "", err
 			}
 		}
 
+		if bucket.calendar() {
+			if queryFills(query) {
+				return "", fmt.Errorf("the fill setting of the query can not be combined with calendar units, a time zone, an origin or an offset of $__timeGroup")
+			}
+			return bucket.sql()
+		}
+
 		if m.timescaledb {
 			return fmt.Sprintf("time_bucket('%.3fs',%s)", interval.Seconds(), args[0]), nil
 		}
@@ -117,6 +150,55 @@ func (m *postgresMacroEngine) evaluateMacro(timeRange backend.TimeRange, query *
 			return tg + " AS \"time\"", nil
 		}
 		return "", err
+	case "__rollupTable":
+		base := strings.Trim(args[0], `'"`)
+		if base == "" {
+			return "", fmt.Errorf("missing table argument for macro %v", name)
+		}
+		rollups, ok := m.rollups[base]
+		if !ok {
+			return "", fmt.Errorf("no rollup tables configured for %q", base)
+		}
+		rollup := sqleng.ChooseRollup(rollups, query.Interval)
+		if err := sqleng.SetRollupTable(query, base, rollup.Table); err != nil {
+			return "", err
+		}
+		return rollup.Table, nil
+	case "__snapshot":
+		// the query was pinned to the snapshot by its argument already
+		snapshot := sqleng.QuerySnapshot(*query)
+		if snapshot == "" {
+			return "NULL", nil
+		}
+		return "'" + strings.ReplaceAll(snapshot, "'", "''") + "'", nil
+	case "__histogram":
+		if len(args) < 2 || len(args) > 3 {
+			return "", fmt.Errorf("macro %v needs a column, the buckets or a bucket size and optionally log", name)
+		}
+		value := fmt.Sprintf("CAST(%s AS DOUBLE)", args[0])
+		if strings.HasPrefix(args[1], "[") {
+			if len(args) == 3 {
+				return "", fmt.Errorf("macro %v needs a base instead of buckets for log buckets", name)
+			}
+			// the buckets are the upper bounds, values above the last one are counted at inf
+			return fmt.Sprintf("histogram(%s, CAST(%s AS DOUBLE[]))", value, args[1]), nil
+		}
+		size, err := strconv.ParseFloat(strings.Trim(args[1], `'`), 64)
+		if err != nil || size <= 0 {
+			return "", fmt.Errorf("error parsing bucket size %v", args[1])
+		}
+		if len(args) == 3 {
+			if args[2] != "log" {
+				return "", fmt.Errorf("unknown bucket scale %v", args[2])
+			}
+			if size <= 1 {
+				return "", fmt.Errorf("the base of log buckets must be greater than 1")
+			}
+			// the upper bound of a bucket is the next power of the base, values up to 0 are not counted
+			return fmt.Sprintf("histogram(CASE WHEN %s > 0 THEN pow(%v, ceil(ln(%s) / ln(%v))) END)", value, size, value, size), nil
+		}
+		// the upper bound of the bucket, like the le buckets of Prometheus
+		return fmt.Sprintf("histogram(ceil(%s / %v) * %v)", value, size, size), nil
 	case "__unixEpochFilter":
 		if len(args) == 0 {
 			return "", fmt.Errorf("missing time column argument for macro %v", name)
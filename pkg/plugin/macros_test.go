@@ -0,0 +1,258 @@
+package plugin
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/omaha/duckdb/pkg/plugin/sqleng"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeGroupMacro(t *testing.T) {
+	timeRange := backend.TimeRange{From: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)}
+	interpolate := func(t *testing.T, engine *postgresMacroEngine, sql string) string {
+		query := &backend.DataQuery{JSON: []byte(`{}`)}
+		res, err := engine.Interpolate(query, timeRange, sql)
+		require.NoError(t, err)
+		return res
+	}
+	utc := newPostgresMacroEngine(false, "", nil, nil).(*postgresMacroEngine)
+
+	t.Run("Should keep fixed UTC buckets on epoch seconds", func(t *testing.T) {
+		require.Equal(t, "SELECT floor(extract(epoch from ts)/3600)*3600", interpolate(t, utc, "SELECT $__timeGroup(ts, 1h)"))
+	})
+
+	t.Run("Should use time_bucket for calendar units", func(t *testing.T) {
+		require.Equal(t, `SELECT time_bucket(INTERVAL '1 months', ts) AS "time"`, interpolate(t, utc, "SELECT $__timeGroupAlias(ts, 1M)"))
+		require.Equal(t, "time_bucket(INTERVAL '2 weeks', ts)", interpolate(t, utc, "$__timeGroup(ts, '2w')"))
+		require.Equal(t, "time_bucket(INTERVAL '1 years', ts)", interpolate(t, utc, "$__timeGroup(ts, 1y)"))
+	})
+
+	t.Run("Should parse nested calls and skip literals and comments", func(t *testing.T) {
+		require.Equal(t, `SELECT floor(extract(epoch from date_trunc('hour', ts))/3600)*3600 AS "time", '$__timeTo()' -- $__timeFrom()`+"\n",
+			interpolate(t, utc, "SELECT $__timeGroup(date_trunc('hour', ts), 1h), '$__timeTo()' -- $__timeFrom()\n"))
+		require.Equal(t, "SELECT rank() OVER (ORDER BY floor(extract(epoch from ts)/60)*60), floor(extract(epoch from ts)/60)*60 AS \"time\", y",
+			interpolate(t, utc, "SELECT rank() OVER (ORDER BY $__timeGroup(ts, 1m)), $__timeGroup(ts, 1m), y"))
+	})
+
+	t.Run("Should bucket in a time zone", func(t *testing.T) {
+		require.Equal(t, "time_bucket(INTERVAL '1 days', CAST(ts AS TIMESTAMPTZ), 'Europe/Berlin')",
+			interpolate(t, utc, "$__timeGroup(ts, 1d, 'Europe/Berlin')"))
+
+		berlin := newPostgresMacroEngine(false, "Europe/Berlin", nil, nil).(*postgresMacroEngine)
+		require.Equal(t, "time_bucket(INTERVAL '1 days', CAST(ts AS TIMESTAMPTZ), 'Europe/Berlin')", interpolate(t, berlin, "$__timeGroup(ts, 1d, tz)"))
+		require.Equal(t, "floor(extract(epoch from ts)/86400)*86400", interpolate(t, berlin, "$__timeGroup(ts, 1d)"))
+		require.Equal(t, "floor(extract(epoch from ts)/86400)*86400", interpolate(t, berlin, "$__timeGroup(ts, 1d, 'UTC')"))
+		require.Equal(t, "time_bucket(INTERVAL '1 days', CAST(ts AS TIMESTAMPTZ) - INTERVAL '6 hours', 'Europe/Berlin') + INTERVAL '6 hours'",
+			interpolate(t, berlin, "$__timeGroup(ts, 1d, tz, offset='6h')"))
+		require.Equal(t, "", newPostgresMacroEngine(false, "browser", nil, nil).(*postgresMacroEngine).timezone)
+	})
+
+	t.Run("Should support origin and offset", func(t *testing.T) {
+		require.Equal(t, "time_bucket(INTERVAL '1 days', ts, TIMESTAMP '2024-01-01 06:00:00')", interpolate(t, utc, "$__timeGroup(ts, 1d, origin='2024-01-01 06:00:00')"))
+		require.Equal(t, "time_bucket(INTERVAL '1 days', ts, -INTERVAL '30 minutes')", interpolate(t, utc, "$__timeGroup(ts, 1d, offset='-30m')"))
+
+		query := &backend.DataQuery{JSON: []byte(`{}`)}
+		res, err := utc.Interpolate(query, timeRange, "$__timeGroup(ts, 1d, 0)")
+		require.NoError(t, err)
+		require.Equal(t, "floor(extract(epoch from ts)/86400)*86400", res)
+		require.JSONEq(t, `{"fill": true, "fillInterval": 86400, "fillMode": "value", "fillValue": 0}`, string(query.JSON))
+	})
+
+	t.Run("Should reject invalid arguments", func(t *testing.T) {
+		for _, sql := range []string{
+			"$__timeGroup(ts, 1d, 'Mars/Olympus')",
+			"$__timeGroup(ts, 1d, origin='yesterday')",
+			"$__timeGroup(ts, 1d, offset='1 day; DROP')",
+			"$__timeGroup(ts, 1d, origin='2024-01-01', 'Europe/Berlin')",
+			"$__timeGroup(ts, 1d, width=2)",
+			"$__timeGroup(ts, 1d, tz)",
+			"$__timeGroup(ts, 1M, 0)",
+			"$__timeGroup(ts, 1d, NULL, 'Europe/Berlin')",
+			"$__timeGroup(ts, 1d, previous, offset='-30m')",
+		} {
+			_, err := utc.Interpolate(&backend.DataQuery{JSON: []byte(`{}`)}, timeRange, sql)
+			require.Error(t, err, sql)
+		}
+		_, err := utc.Interpolate(&backend.DataQuery{JSON: []byte(`{"fill": true}`)}, timeRange, "$__timeGroup(ts, 1w)")
+		require.ErrorContains(t, err, "fill setting")
+	})
+
+	t.Run("Should align calendar buckets in DuckDB", func(t *testing.T) {
+		db, err := sql.Open("duckdb", "")
+		require.NoError(t, err)
+		defer db.Close()
+
+		var month, week string
+		require.NoError(t, db.QueryRow("SELECT CAST("+interpolate(t, utc, "$__timeGroup(TIMESTAMP '2024-03-31 12:00:00', 1M)")+" AS VARCHAR), CAST("+
+			interpolate(t, utc, "$__timeGroup(TIMESTAMP '2024-03-31 12:00:00', 1w)")+" AS VARCHAR)").Scan(&month, &week))
+		require.Equal(t, "2024-03-01 00:00:00", month)
+		require.Equal(t, "2024-03-25 00:00:00", week)
+	})
+}
+
+func TestCustomMacros(t *testing.T) {
+	timeRange := backend.TimeRange{From: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)}
+	macros := []sqleng.CustomMacro{
+		{Name: "tenantFilter", Template: "tenant_id = current_setting('tenant')"},
+		{Name: "$businessHours", Params: []string{"col"}, Template: "$__timeFilter($col) AND hour($col) BETWEEN 9 AND 17"},
+		{Name: "scoped", Params: []string{"col", "bucket"}, Template: "$__timeGroup($col, $bucket) AS t, count(*) FROM events WHERE $tenantFilter() AND $businessHours($col)"},
+		{Name: "loop", Template: "$loop()"},
+		{Name: "myCol", Template: "coalesce(event_time, ingest_time)"},
+		{Name: "tsExpr", Template: "CAST($myCol() AS TIMESTAMP)"},
+	}
+	require.NoError(t, validateCustomMacros(macros))
+	engine := newPostgresMacroEngine(false, "", macros, nil).(*postgresMacroEngine)
+
+	interpolate := func(sql string) (string, error) {
+		return engine.Interpolate(&backend.DataQuery{JSON: []byte(`{}`), Interval: time.Minute}, timeRange, sql)
+	}
+
+	t.Run("Should expand custom macros with their arguments", func(t *testing.T) {
+		sql, err := interpolate("SELECT * FROM events WHERE $tenantFilter()")
+		require.NoError(t, err)
+		require.Equal(t, "SELECT * FROM events WHERE tenant_id = current_setting('tenant')", sql)
+	})
+
+	t.Run("Should expand built-in and custom macros inside templates", func(t *testing.T) {
+		sql, err := interpolate("SELECT $scoped(ts, $__interval)")
+		require.NoError(t, err)
+		require.Equal(t, "SELECT floor(extract(epoch from ts)/60)*60 AS t, count(*) FROM events WHERE tenant_id = current_setting('tenant') AND "+
+			"ts BETWEEN '2024-01-01T00:00:00Z' AND '2024-01-02T00:00:00Z' AND hour(ts) BETWEEN 9 AND 17", sql)
+	})
+
+	t.Run("Should expand custom macros inside the arguments of built-in macros", func(t *testing.T) {
+		sql, err := interpolate("SELECT $__timeGroup($myCol(), 1h), count(*) FROM events")
+		require.NoError(t, err)
+		require.Equal(t, `SELECT floor(extract(epoch from coalesce(event_time, ingest_time))/3600)*3600 AS "time", count(*) FROM events`, sql)
+
+		sql, err = interpolate("SELECT * FROM events WHERE $__timeFilter($tsExpr())")
+		require.NoError(t, err)
+		require.Equal(t, "SELECT * FROM events WHERE CAST(coalesce(event_time, ingest_time) AS TIMESTAMP) BETWEEN '2024-01-01T00:00:00Z' AND '2024-01-02T00:00:00Z'", sql)
+
+		_, err = interpolate("SELECT $__timeFilter($loop())")
+		require.ErrorContains(t, err, "nests")
+	})
+
+	t.Run("Should fail on wrong argument counts and endless nesting", func(t *testing.T) {
+		_, err := interpolate("$businessHours()")
+		require.Error(t, err)
+		_, err = interpolate("$loop()")
+		require.ErrorContains(t, err, "nests")
+	})
+
+	t.Run("Should reject invalid definitions", func(t *testing.T) {
+		require.Error(t, validateCustomMacros([]sqleng.CustomMacro{{Name: "__timeFilter"}}))
+		require.Error(t, validateCustomMacros([]sqleng.CustomMacro{{Name: "$__interval_ms"}}))
+		require.Error(t, validateCustomMacros([]sqleng.CustomMacro{{Name: "a"}, {Name: "$a"}}))
+		require.Error(t, validateCustomMacros([]sqleng.CustomMacro{{Name: "bad name"}}))
+		require.Error(t, validateCustomMacros([]sqleng.CustomMacro{{Name: "ok", Params: []string{"x", "x"}}}))
+	})
+}
+
+func TestTimeShiftMacros(t *testing.T) {
+	timeRange := backend.TimeRange{From: time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), To: time.Date(2024, 1, 9, 0, 0, 0, 0, time.UTC)}
+	engine := newPostgresMacroEngine(false, "", nil, nil)
+
+	interpolate := func(sql string) (string, error) {
+		return engine.Interpolate(&backend.DataQuery{JSON: []byte(`{}`)}, timeRange, sql)
+	}
+
+	t.Run("Should shift the time range back", func(t *testing.T) {
+		sql, err := interpolate("WHERE $__timeFilterShifted(ts, '7d') AND ts > $__timeFromShifted('1d') AND ts < $__timeToShifted(1h)")
+		require.NoError(t, err)
+		require.Equal(t, "WHERE ts BETWEEN '2024-01-01T00:00:00Z' AND '2024-01-02T00:00:00Z' AND ts > '2024-01-07T00:00:00Z' AND ts < '2024-01-08T23:00:00Z'", sql)
+	})
+
+	t.Run("Should reject missing and invalid shifts", func(t *testing.T) {
+		for _, sql := range []string{"$__timeFilterShifted(ts)", "$__timeFromShifted()", "$__timeToShifted('-1d')", "$__timeToShifted(soon)"} {
+			_, err := interpolate(sql)
+			require.Error(t, err, sql)
+		}
+	})
+}
+
+func TestRollupTableMacro(t *testing.T) {
+	rollups, err := sqleng.ParseRollups(map[string]map[string]string{"metrics": {"metrics_raw": "raw", "metrics_1m": "1m", "metrics_1h": "1h"}})
+	require.NoError(t, err)
+	engine := newPostgresMacroEngine(false, "", nil, rollups)
+
+	interpolate := func(t *testing.T, interval time.Duration, sql string) (string, *backend.DataQuery) {
+		query := &backend.DataQuery{JSON: []byte(`{"rawSql": ""}`), Interval: interval}
+		res, err := engine.Interpolate(query, backend.TimeRange{}, sql)
+		require.NoError(t, err)
+		return res, query
+	}
+
+	t.Run("Should read the rollup matching the interval", func(t *testing.T) {
+		sql, query := interpolate(t, 5*time.Minute, "SELECT * FROM $__rollupTable(metrics)")
+		require.Equal(t, "SELECT * FROM metrics_1m", sql)
+		require.JSONEq(t, `{"rawSql": "", "rollupTables": {"metrics": "metrics_1m"}}`, string(query.JSON))
+
+		sql, _ = interpolate(t, 10*time.Second, "SELECT * FROM $__rollupTable('metrics')")
+		require.Equal(t, "SELECT * FROM metrics_raw", sql)
+	})
+
+	t.Run("Should fail for unknown tables", func(t *testing.T) {
+		_, err := engine.Interpolate(&backend.DataQuery{JSON: []byte(`{}`)}, backend.TimeRange{}, "$__rollupTable(events)")
+		require.ErrorContains(t, err, "no rollup tables")
+		_, err = engine.Interpolate(&backend.DataQuery{JSON: []byte(`{}`)}, backend.TimeRange{}, "$__rollupTable()")
+		require.Error(t, err)
+	})
+}
+
+func TestHistogramMacro(t *testing.T) {
+	engine := newPostgresMacroEngine(false, "", nil, nil)
+	interpolate := func(sql string) (string, error) {
+		return engine.Interpolate(&backend.DataQuery{JSON: []byte(`{}`)}, backend.TimeRange{}, sql)
+	}
+
+	t.Run("Should count values per bucket", func(t *testing.T) {
+		sql, err := interpolate("SELECT $__histogram(latency, [0.1, 0.5, 1]) AS latency")
+		require.NoError(t, err)
+		require.Equal(t, "SELECT histogram(CAST(latency AS DOUBLE), CAST([0.1, 0.5, 1] AS DOUBLE[])) AS latency", sql)
+
+		sql, err = interpolate("$__histogram(latency, 0.5)")
+		require.NoError(t, err)
+		require.Equal(t, "histogram(ceil(CAST(latency AS DOUBLE) / 0.5) * 0.5)", sql)
+	})
+
+	t.Run("Should bucket in DuckDB", func(t *testing.T) {
+		db, err := sql.Open("duckdb", "")
+		require.NoError(t, err)
+		defer db.Close()
+
+		for macro, expected := range map[string]string{
+			"$__histogram(x, [2, 5])": "{2.0=3, 5.0=3, inf=4}",
+			"$__histogram(x, 4)":      "{0.0=1, 4.0=4, 8.0=4, 12.0=1}",
+			"$__histogram(x, 2, log)": "{1.0=1, 2.0=1, 4.0=2, 8.0=4, 16.0=1}",
+		} {
+			query, err := interpolate("SELECT CAST(" + macro + " AS VARCHAR) FROM range(10) t(x)")
+			require.NoError(t, err)
+			var buckets string
+			require.NoError(t, db.QueryRow(query).Scan(&buckets))
+			require.Equal(t, expected, buckets, macro)
+		}
+	})
+
+	t.Run("Should reject invalid buckets", func(t *testing.T) {
+		for _, sql := range []string{"$__histogram(x)", "$__histogram(x, 0)", "$__histogram(x, many)", "$__histogram(x, 1, log)", "$__histogram(x, 2, sqrt)", "$__histogram(x, [1, 2], log)"} {
+			_, err := interpolate(sql)
+			require.Error(t, err, sql)
+		}
+	})
+}
+
+func TestSnapshotMacro(t *testing.T) {
+	engine := newPostgresMacroEngine(false, "", nil, nil)
+
+	sql, err := engine.Interpolate(&backend.DataQuery{JSON: []byte(`{"snapshot": "sales-2026-10-17T06"}`)}, backend.TimeRange{}, "SELECT $__snapshot() AS snapshot, $__snapshot('sales-2026-10-17T06') AS pinned")
+	require.NoError(t, err)
+	require.Equal(t, "SELECT 'sales-2026-10-17T06' AS snapshot, 'sales-2026-10-17T06' AS pinned", sql)
+
+	sql, err = engine.Interpolate(&backend.DataQuery{JSON: []byte(`{}`)}, backend.TimeRange{}, "SELECT $__snapshot()")
+	require.NoError(t, err)
+	require.Equal(t, "SELECT NULL", sql)
+}
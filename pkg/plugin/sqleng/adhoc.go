@@ -0,0 +1,288 @@
+package sqleng
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const defaultTagValuesLimit = 1000
+
+// AdhocFilter is a filter of the dashboard ad-hoc filter bar
+type AdhocFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+// condition renders the filter as a WHERE condition. Regex operators compare the textual value of the column.
+func (f AdhocFilter) condition() (string, error) {
+	column := quoteIdentifier(f.Key)
+	value := quoteLiteral(f.Value)
+	switch f.Operator {
+	case "=", "!=":
+		return fmt.Sprintf("%s %s %s", column, f.Operator, value), nil
+	case "=~":
+		return fmt.Sprintf("regexp_matches(CAST(%s AS VARCHAR), %s)", column, value), nil
+	case "!~":
+		return fmt.Sprintf("NOT regexp_matches(CAST(%s AS VARCHAR), %s)", column, value), nil
+	default:
+		return "", fmt.Errorf("unsupported ad-hoc filter operator %q", f.Operator)
+	}
+}
+
+// applyAdhocFilters wraps the query as a subquery filtered by the ad-hoc filters. Filters on columns the query does
+// not return are skipped, so that a filter bar shared by the whole dashboard does not break unrelated panels, and
+// their keys are returned to be reported.
+func applyAdhocFilters(query string, filters []AdhocFilter, columns []describedColumn) (string, []string, error) {
+	available := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		available[column.name] = true
+	}
+
+	var conditions, skipped []string
+	for _, filter := range filters {
+		if !available[filter.Key] {
+			skipped = append(skipped, filter.Key)
+			continue
+		}
+		condition, err := filter.condition()
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	if len(conditions) == 0 {
+		return query, skipped, nil
+	}
+
+	return fmt.Sprintf("SELECT * FROM (%s) AS adhoc_query WHERE %s",
+		strings.TrimRight(strings.TrimSpace(query), ";"), strings.Join(conditions, " AND ")), skipped, nil
+}
+
+// skippedAdhocFiltersNotice tells that filters of the filter bar did not apply to the query
+func skippedAdhocFiltersNotice(keys []string) data.Notice {
+	return data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     fmt.Sprintf("ad-hoc filters on %s were not applied, the query does not return these columns", strings.Join(keys, ", ")),
+	}
+}
+
+type tagKey struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type tagValue struct {
+	Text string `json:"text"`
+}
+
+// splitTableName separates an optional schema from a table name
+func splitTableName(name string) (string, string) {
+	if schema, table, ok := strings.Cut(name, "."); ok {
+		return schema, table
+	}
+	return "", name
+}
+
+// adhocTableName splits the table of the ad-hoc filters, tables without a schema are in main
+func adhocTableName(table string) (string, string) {
+	schema, name := splitTableName(table)
+	if schema == "" {
+		schema = "main"
+	}
+	return schema, name
+}
+
+// adhocTable returns the table selected by the request, falling back to the one configured for the datasource
+func (e *DataSourceHandler) adhocTable(req *http.Request) string {
+	if table := req.URL.Query().Get("table"); table != "" {
+		return table
+	}
+	return e.dsInfo.JsonData.AdhocTable
+}
+
+// adhocDatabase returns the database generation of the snapshot selected by the request, the newest one by default
+func (e *DataSourceHandler) adhocDatabase(req *http.Request) (*sql.DB, error) {
+	db, _, err := e.snapshotDatabase(req.URL.Query().Get("snapshot"))
+	return db, err
+}
+
+// listTagKeys returns the columns of the table, or of every table when none is given
+func (e *DataSourceHandler) listTagKeys(ctx context.Context, db *sql.DB, table string) ([]tagKey, error) {
+	query := "SELECT column_name, max(data_type) FROM duckdb_columns() WHERE internal = false"
+	var args []any
+	if table != "" {
+		schema, name := adhocTableName(table)
+		query += " AND schema_name = ? AND table_name = ?"
+		args = append(args, schema, name)
+	}
+	query += " GROUP BY column_name ORDER BY column_name"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			e.log.Warn("Failed to close rows", "err", err)
+		}
+	}()
+
+	keys := []tagKey{}
+	for rows.Next() {
+		var key tagKey
+		if err := rows.Scan(&key.Text, &key.Type); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+var (
+	errUnknownColumn   = errors.New("unknown column")
+	errAmbiguousColumn = errors.New("ambiguous column")
+)
+
+// columnTable finds the only table with the column, for tag values requested without a table like the tag keys
+// of every table. It returns the quoted table with its catalog and schema.
+func (e *DataSourceHandler) columnTable(ctx context.Context, db *sql.DB, key string) (string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT database_name, schema_name, table_name FROM duckdb_columns() WHERE internal = false AND column_name = ? ORDER BY ALL", key)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			e.log.Warn("Failed to close rows", "err", err)
+		}
+	}()
+
+	var tables []string
+	for rows.Next() {
+		var catalog, schema, name string
+		if err := rows.Scan(&catalog, &schema, &name); err != nil {
+			return "", err
+		}
+		tables = append(tables, quoteIdentifier(catalog)+"."+quoteIdentifier(schema)+"."+quoteIdentifier(name))
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	switch len(tables) {
+	case 0:
+		return "", fmt.Errorf("%w %q", errUnknownColumn, key)
+	case 1:
+		return tables[0], nil
+	default:
+		return "", fmt.Errorf("%w %q is in the tables %s, select one", errAmbiguousColumn, key, strings.Join(tables, ", "))
+	}
+}
+
+// listTagValues returns the distinct values of a column. The table and column are checked against duckdb_columns
+// before they are put into the query. Without a table, the column must be in a single table.
+func (e *DataSourceHandler) listTagValues(ctx context.Context, db *sql.DB, table string, key string, search string, limit int) ([]tagValue, error) {
+	var source string
+	if table == "" {
+		var err error
+		if source, err = e.columnTable(ctx, db, key); err != nil {
+			return nil, err
+		}
+	} else {
+		schema, name := adhocTableName(table)
+		var count int
+		if err := db.QueryRowContext(ctx, "SELECT count(*) FROM duckdb_columns() WHERE schema_name = ? AND table_name = ? AND column_name = ?",
+			schema, name, key).Scan(&count); err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, fmt.Errorf("%w %q in table %q", errUnknownColumn, key, table)
+		}
+		source = quoteIdentifier(schema) + "." + quoteIdentifier(name)
+	}
+
+	column := quoteIdentifier(key)
+	query := fmt.Sprintf("SELECT DISTINCT CAST(%s AS VARCHAR) AS value FROM %s WHERE %s IS NOT NULL", column, source, column)
+	var args []any
+	if search != "" {
+		query += fmt.Sprintf(" AND CAST(%s AS VARCHAR) ILIKE ?", column)
+		args = append(args, "%"+search+"%")
+	}
+	query += " ORDER BY value LIMIT " + strconv.Itoa(limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			e.log.Warn("Failed to close rows", "err", err)
+		}
+	}()
+
+	values := []tagValue{}
+	for rows.Next() {
+		var value tagValue
+		if err := rows.Scan(&value.Text); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func (e *DataSourceHandler) getTagKeys(rw http.ResponseWriter, req *http.Request) {
+	db, err := e.adhocDatabase(req)
+	if err != nil {
+		writeResourceError(rw, http.StatusBadRequest, err)
+		return
+	}
+	keys, err := e.listTagKeys(req.Context(), db, e.adhocTable(req))
+	if err != nil {
+		e.log.Error("error listing tag keys", "error", err)
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeResourceJSON(rw, keys)
+}
+
+func (e *DataSourceHandler) getTagValues(rw http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	table := e.adhocTable(req)
+	key := params.Get("key")
+	if key == "" {
+		writeResourceError(rw, http.StatusBadRequest, errors.New("key is required"))
+		return
+	}
+
+	limit := defaultTagValuesLimit
+	if l := params.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			writeResourceError(rw, http.StatusBadRequest, fmt.Errorf("invalid limit %q", l))
+			return
+		}
+	}
+
+	db, err := e.adhocDatabase(req)
+	if err != nil {
+		writeResourceError(rw, http.StatusBadRequest, err)
+		return
+	}
+	values, err := e.listTagValues(req.Context(), db, table, key, params.Get("search"), limit)
+	if errors.Is(err, errUnknownColumn) || errors.Is(err, errAmbiguousColumn) {
+		writeResourceError(rw, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		e.log.Error("error listing tag values", "error", err)
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeResourceJSON(rw, values)
+}
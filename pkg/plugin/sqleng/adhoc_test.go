@@ -0,0 +1,140 @@
+package sqleng
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdhocFilters(t *testing.T) {
+	t.Run("Should wrap the query with quoted conditions", func(t *testing.T) {
+		columns := []describedColumn{{name: "host", columnType: "VARCHAR"}, {name: "my col", columnType: "VARCHAR"}}
+		sql, skipped, err := applyAdhocFilters("SELECT * FROM t;", []AdhocFilter{
+			{Key: "host", Operator: "=", Value: "it's"},
+			{Key: "my col", Operator: "!~", Value: "^a.*"},
+			{Key: "missing", Operator: "=", Value: "x"},
+		}, columns)
+		require.NoError(t, err)
+		require.Equal(t, `SELECT * FROM (SELECT * FROM t) AS adhoc_query WHERE "host" = 'it''s' AND NOT regexp_matches(CAST("my col" AS VARCHAR), '^a.*')`, sql)
+		require.Equal(t, []string{"missing"}, skipped)
+	})
+
+	t.Run("Should leave the query alone when no filter applies", func(t *testing.T) {
+		sql, skipped, err := applyAdhocFilters("SELECT 1", []AdhocFilter{{Key: "host", Operator: "=", Value: "a"}}, nil)
+		require.NoError(t, err)
+		require.Equal(t, "SELECT 1", sql)
+		require.Equal(t, []string{"host"}, skipped)
+	})
+
+	t.Run("Should reject unknown operators", func(t *testing.T) {
+		_, _, err := applyAdhocFilters("SELECT 1", []AdhocFilter{{Key: "host", Operator: "<>", Value: "a"}}, []describedColumn{{name: "host"}})
+		require.Error(t, err)
+	})
+
+	handler := newTestHandler(t, JsonData{AdhocTable: "requests"},
+		"CREATE TABLE requests (host VARCHAR, region VARCHAR, status INTEGER)",
+		"INSERT INTO requests VALUES ('web-1', 'eu', 200), ('web-2', 'eu', 500), ('api-1', 'us', 200), ('web-1', 'eu', 404)",
+		"CREATE TABLE other (name VARCHAR)",
+		"CREATE SCHEMA audit",
+		"CREATE TABLE audit.requests (actor VARCHAR)",
+	)
+
+	resource := func(t *testing.T, url string) *backend.CallResourceResponse {
+		sender := &testResourceSender{}
+		path, _, _ := strings.Cut(url, "?")
+		require.NoError(t, handler.CallResource(context.Background(), &backend.CallResourceRequest{Method: "GET", Path: path, URL: url}, sender))
+		return sender.response
+	}
+
+	t.Run("Should list the columns of the configured table as tag keys", func(t *testing.T) {
+		res := resource(t, "/tag-keys")
+		require.Equal(t, http.StatusOK, res.Status)
+		var keys []tagKey
+		require.NoError(t, json.Unmarshal(res.Body, &keys))
+		require.Equal(t, []tagKey{{Text: "host", Type: "VARCHAR"}, {Text: "region", Type: "VARCHAR"}, {Text: "status", Type: "INTEGER"}}, keys)
+
+		res = resource(t, "/tag-keys?table=other")
+		require.NoError(t, json.Unmarshal(res.Body, &keys))
+		require.Equal(t, []tagKey{{Text: "name", Type: "VARCHAR"}}, keys)
+
+		res = resource(t, "/tag-keys?table=audit.requests")
+		require.NoError(t, json.Unmarshal(res.Body, &keys))
+		require.Equal(t, []tagKey{{Text: "actor", Type: "VARCHAR"}}, keys)
+	})
+
+	t.Run("Should list distinct tag values with search and limit", func(t *testing.T) {
+		res := resource(t, "/tag-values?key=host&search=WEB&limit=1")
+		require.Equal(t, http.StatusOK, res.Status)
+		var values []tagValue
+		require.NoError(t, json.Unmarshal(res.Body, &values))
+		require.Equal(t, []tagValue{{Text: "web-1"}}, values)
+
+		res = resource(t, "/tag-values?key=status")
+		require.NoError(t, json.Unmarshal(res.Body, &values))
+		require.Equal(t, []tagValue{{Text: "200"}, {Text: "404"}, {Text: "500"}}, values)
+	})
+
+	t.Run("Should reject unknown tag value columns", func(t *testing.T) {
+		res := resource(t, `/tag-values?key=host"%3B%20DROP`)
+		require.Equal(t, http.StatusBadRequest, res.Status)
+	})
+
+	t.Run("Should find the table of the tag values when none is configured", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{},
+			"CREATE TABLE requests (host VARCHAR, status INTEGER)",
+			"INSERT INTO requests VALUES ('web-1', 200), ('web-2', 500)",
+			"CREATE TABLE hosts (host VARCHAR, rack VARCHAR)",
+			"INSERT INTO hosts VALUES ('web-1', 'r1'), ('web-1', 'r2')",
+		)
+		resource := func(t *testing.T, url string) *backend.CallResourceResponse {
+			sender := &testResourceSender{}
+			path, _, _ := strings.Cut(url, "?")
+			require.NoError(t, handler.CallResource(context.Background(), &backend.CallResourceRequest{Method: "GET", Path: path, URL: url}, sender))
+			return sender.response
+		}
+
+		res := resource(t, "/tag-values?key=rack")
+		require.Equal(t, http.StatusOK, res.Status)
+		var values []tagValue
+		require.NoError(t, json.Unmarshal(res.Body, &values))
+		require.Equal(t, []tagValue{{Text: "r1"}, {Text: "r2"}}, values)
+
+		res = resource(t, "/tag-values?key=host")
+		require.Equal(t, http.StatusBadRequest, res.Status)
+		require.Contains(t, string(res.Body), "ambiguous column")
+		res = resource(t, "/tag-values?key=host&table=requests")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.Equal(t, http.StatusBadRequest, resource(t, "/tag-values?key=missing").Status)
+		require.Equal(t, http.StatusBadRequest, resource(t, "/tag-values").Status)
+	})
+
+	t.Run("Should apply ad-hoc filters sent with the query", func(t *testing.T) {
+		res := queryData(t, handler, backend.DataQuery{
+			JSON: []byte(`{"rawSql": "SELECT host, status FROM requests ORDER BY status", "format": "table", "adhocFilters": [
+				{"key": "host", "operator": "=~", "value": "^web"},
+				{"key": "status", "operator": "!=", "value": "404"},
+				{"key": "region", "operator": "=", "value": "us"}
+			]}`),
+		})
+		require.NoError(t, res.Error)
+		require.Equal(t, 2, res.Frames[0].Rows())
+		require.Equal(t, "web-1", *res.Frames[0].Fields[0].At(0).(*string))
+		require.Equal(t, "web-2", *res.Frames[0].Fields[0].At(1).(*string))
+		require.Len(t, res.Frames[0].Meta.Notices, 1)
+		require.Equal(t, data.NoticeSeverityWarning, res.Frames[0].Meta.Notices[0].Severity)
+		require.Contains(t, res.Frames[0].Meta.Notices[0].Text, "ad-hoc filters on region were not applied")
+	})
+
+	t.Run("Should fail instead of running unfiltered when the query cannot be described", func(t *testing.T) {
+		res := queryData(t, handler, backend.DataQuery{
+			JSON: []byte(`{"rawSql": "SELECT host FROM missing_table", "format": "table", "adhocFilters": [{"key": "host", "operator": "=", "value": "web-1"}]}`),
+		})
+		require.ErrorContains(t, res.Error, "describing the query for the ad-hoc filters failed")
+	})
+}
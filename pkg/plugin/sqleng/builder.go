@@ -0,0 +1,304 @@
+package sqleng
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+)
+
+// builderAggregates are the aggregate functions the query builder may use, mapped to their SQL template
+var builderAggregates = map[string]string{
+	"avg":                   "avg(%s)",
+	"sum":                   "sum(%s)",
+	"min":                   "min(%s)",
+	"max":                   "max(%s)",
+	"count":                 "count(%s)",
+	"count_distinct":        "count(DISTINCT %s)",
+	"approx_count_distinct": "approx_count_distinct(%s)",
+	"median":                "median(%s)",
+	"mode":                  "mode(%s)",
+	"stddev":                "stddev(%s)",
+	"stddev_pop":            "stddev_pop(%s)",
+	"stddev_samp":           "stddev_samp(%s)",
+	"variance":              "variance(%s)",
+	"var_pop":               "var_pop(%s)",
+	"var_samp":              "var_samp(%s)",
+	"first":                 "first(%s)",
+	"last":                  "last(%s)",
+	"any_value":             "any_value(%s)",
+}
+
+// BuilderQuery is the structured query of the visual query editor (the "sql" property of the query model)
+type BuilderQuery struct {
+	Columns          []BuilderColumn   `json:"columns"`
+	WhereFilters     []BuilderFilter   `json:"whereFilters"`
+	WhereString      string            `json:"whereString"`
+	GroupBy          []BuilderProperty `json:"groupBy"`
+	OrderBy          *BuilderProperty  `json:"orderBy"`
+	OrderByDirection string            `json:"orderByDirection"`
+	Limit            *int              `json:"limit"`
+}
+
+// BuilderColumn is a select expression: a column, optionally wrapped in an aggregate function
+type BuilderColumn struct {
+	Name       string `json:"name"`
+	Alias      string `json:"alias"`
+	Parameters []struct {
+		Name string `json:"name"`
+	} `json:"parameters"`
+}
+
+// BuilderProperty references a column in group-by and order-by. A group-by with an interval buckets the column
+// by time.
+type BuilderProperty struct {
+	Property struct {
+		Name string `json:"name"`
+	} `json:"property"`
+	Interval string `json:"interval"`
+}
+
+// BuilderFilter is a single where-condition
+type BuilderFilter struct {
+	Column   string `json:"column"`
+	Operator string `json:"operator"`
+	Value    any    `json:"value"`
+}
+
+func (q *QueryJson) hasBuilderQuery() bool {
+	return q.Table != "" && q.Sql != nil
+}
+
+// tableColumns returns the columns of a table as known to duckdb_columns
+func (e *DataSourceHandler) tableColumns(ctx context.Context, db *sql.DB, schema string, table string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT column_name FROM duckdb_columns() WHERE schema_name = ? AND table_name = ?", schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			e.log.Warn("Failed to close rows", "err", err)
+		}
+	}()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// compileBuilderQuery compiles the structured query into DuckDB SQL. Every identifier is checked against
+// duckdb_columns and quoted. Time buckets use the $__timeGroupAlias and $__timeFilter macros, so the result still
+// goes through the regular macro interpolation. The columns are the ones of the snapshot the query is pinned to.
+func (e *DataSourceHandler) compileBuilderQuery(ctx context.Context, queryJson QueryJson) (string, error) {
+	if !queryJson.hasBuilderQuery() {
+		return "", errors.New("builder query needs a table")
+	}
+	db, _, err := e.snapshotDatabase(querySnapshot(queryJson))
+	if err != nil {
+		return "", err
+	}
+
+	schema, table := splitTableName(queryJson.Table)
+	if schema == "" {
+		schema = queryJson.Dataset
+	}
+	if schema == "" {
+		schema = "main"
+	}
+
+	columns, err := e.tableColumns(ctx, db, schema, table)
+	if err != nil {
+		return "", err
+	}
+	if len(columns) == 0 {
+		return "", fmt.Errorf("unknown table %q", queryJson.Table)
+	}
+	return compileBuilderQuery(schema, table, *queryJson.Sql, columns)
+}
+
+func compileBuilderQuery(schema string, table string, q BuilderQuery, columns map[string]bool) (string, error) {
+	column := func(name string) (string, error) {
+		if !columns[name] {
+			return "", fmt.Errorf("unknown column %q in table %q", name, table)
+		}
+		return quoteIdentifier(name), nil
+	}
+
+	var selects, where []string
+	aliases := make(map[string]bool)
+	bucketed := false
+
+	for _, groupBy := range q.GroupBy {
+		if groupBy.Interval == "" {
+			continue
+		}
+		if bucketed {
+			return "", errors.New("only one group-by can bucket by time")
+		}
+		col, err := column(groupBy.Property.Name)
+		if err != nil {
+			return "", err
+		}
+		interval := groupBy.Interval
+		if interval == "auto" {
+			interval = "$__interval"
+		}
+		if _, err := gtime.ParseInterval(interval); interval != "$__interval" && err != nil {
+			return "", fmt.Errorf("invalid group-by interval %q", groupBy.Interval)
+		}
+		// the bucket comes first so that it is the time column of the result
+		selects = append(selects, fmt.Sprintf("$__timeGroupAlias(%s, %s)", col, interval))
+		where = append(where, fmt.Sprintf("$__timeFilter(%s)", col))
+		aliases["time"] = true
+		bucketed = true
+	}
+
+	for _, groupBy := range q.GroupBy {
+		if groupBy.Interval != "" {
+			continue
+		}
+		col, err := column(groupBy.Property.Name)
+		if err != nil {
+			return "", err
+		}
+		selects = append(selects, col)
+	}
+
+	for _, c := range q.Columns {
+		if len(c.Parameters) != 1 {
+			return "", fmt.Errorf("select expression needs exactly one column")
+		}
+		name := c.Parameters[0].Name
+		var expr string
+		if name == "*" && strings.EqualFold(c.Name, "count") {
+			expr = "*"
+		} else {
+			var err error
+			if expr, err = column(name); err != nil {
+				return "", err
+			}
+		}
+
+		if c.Name != "" {
+			template, ok := builderAggregates[strings.ToLower(c.Name)]
+			if !ok {
+				return "", fmt.Errorf("unsupported aggregate %q", c.Name)
+			}
+			expr = fmt.Sprintf(template, expr)
+		}
+		if c.Alias != "" {
+			expr += " AS " + quoteIdentifier(c.Alias)
+			aliases[c.Alias] = true
+		}
+		selects = append(selects, expr)
+	}
+	if len(selects) == 0 {
+		return "", errors.New("builder query selects no columns")
+	}
+
+	for _, filter := range q.WhereFilters {
+		col, err := column(filter.Column)
+		if err != nil {
+			return "", err
+		}
+		condition, err := filter.condition(col)
+		if err != nil {
+			return "", err
+		}
+		where = append(where, condition)
+	}
+	if q.WhereString != "" {
+		// the free-form condition typed into the editor is taken as is, like a raw query would be
+		where = append(where, "("+q.WhereString+")")
+	}
+
+	sql := "SELECT " + strings.Join(selects, ", ") + " FROM " + quoteIdentifier(schema) + "." + quoteIdentifier(table)
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+	if len(q.GroupBy) > 0 {
+		sql += " GROUP BY ALL"
+	}
+
+	if q.OrderBy != nil && q.OrderBy.Property.Name != "" {
+		name := q.OrderBy.Property.Name
+		if !columns[name] && !aliases[name] {
+			return "", fmt.Errorf("unknown order-by column %q", name)
+		}
+		sql += " ORDER BY " + quoteIdentifier(name)
+		switch strings.ToUpper(q.OrderByDirection) {
+		case "":
+		case "ASC", "DESC":
+			sql += " " + strings.ToUpper(q.OrderByDirection)
+		default:
+			return "", fmt.Errorf("invalid order direction %q", q.OrderByDirection)
+		}
+	} else if bucketed {
+		sql += " ORDER BY 1"
+	}
+
+	if q.Limit != nil {
+		if *q.Limit < 0 {
+			return "", fmt.Errorf("invalid limit %d", *q.Limit)
+		}
+		sql += " LIMIT " + strconv.Itoa(*q.Limit)
+	}
+	return sql, nil
+}
+
+// condition renders the filter against the already quoted column
+func (f BuilderFilter) condition(col string) (string, error) {
+	operator := strings.ToUpper(strings.TrimSpace(f.Operator))
+	switch operator {
+	case "IS NULL", "IS NOT NULL":
+		return col + " " + operator, nil
+	case "IN", "NOT IN":
+		values, ok := f.Value.([]any)
+		if !ok || len(values) == 0 {
+			return "", fmt.Errorf("operator %s needs a list of values", operator)
+		}
+		literals := make([]string, len(values))
+		for i, v := range values {
+			literal, err := sqlLiteral(v)
+			if err != nil {
+				return "", err
+			}
+			literals[i] = literal
+		}
+		return fmt.Sprintf("%s %s (%s)", col, operator, strings.Join(literals, ", ")), nil
+	case "=", "!=", "<>", "<", "<=", ">", ">=", "LIKE", "NOT LIKE", "ILIKE", "NOT ILIKE":
+		literal, err := sqlLiteral(f.Value)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %s", col, operator, literal), nil
+	default:
+		return "", fmt.Errorf("unsupported filter operator %q", f.Operator)
+	}
+}
+
+// sqlLiteral renders a JSON value as a SQL literal
+func sqlLiteral(v any) (string, error) {
+	switch value := v.(type) {
+	case string:
+		return quoteLiteral(value), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case nil:
+		return "NULL", nil
+	default:
+		return "", fmt.Errorf("unsupported filter value %v", v)
+	}
+}
@@ -0,0 +1,94 @@
+package sqleng
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileBuilderQuery(t *testing.T) {
+	columns := map[string]bool{"ts": true, "host": true, "value": true, "my col": true}
+	parse := func(t *testing.T, raw string) BuilderQuery {
+		var q BuilderQuery
+		require.NoError(t, json.Unmarshal([]byte(raw), &q))
+		return q
+	}
+
+	t.Run("Should compile a time bucketed aggregation", func(t *testing.T) {
+		sql, err := compileBuilderQuery("main", "metrics", parse(t, `{
+			"columns": [{"type": "function", "name": "AVG", "alias": "avg value", "parameters": [{"type": "functionParameter", "name": "value"}]}],
+			"groupBy": [{"type": "groupBy", "property": {"type": "string", "name": "ts"}, "interval": "auto"}, {"type": "groupBy", "property": {"type": "string", "name": "host"}}],
+			"whereFilters": [{"column": "my col", "operator": "in", "value": ["a", "it's"]}, {"column": "value", "operator": ">", "value": 1.5}],
+			"limit": 100
+		}`), columns)
+		require.NoError(t, err)
+		require.Equal(t, `SELECT $__timeGroupAlias("ts", $__interval), "host", avg("value") AS "avg value" FROM "main"."metrics" `+
+			`WHERE $__timeFilter("ts") AND "my col" IN ('a', 'it''s') AND "value" > 1.5 GROUP BY ALL ORDER BY 1 LIMIT 100`, sql)
+	})
+
+	t.Run("Should compile plain columns with order", func(t *testing.T) {
+		sql, err := compileBuilderQuery("main", "metrics", parse(t, `{
+			"columns": [{"type": "function", "parameters": [{"name": "host"}]}, {"type": "function", "name": "count", "parameters": [{"name": "*"}]}],
+			"whereString": "value IS NOT NULL",
+			"orderBy": {"type": "property", "property": {"type": "string", "name": "host"}},
+			"orderByDirection": "desc"
+		}`), columns)
+		require.NoError(t, err)
+		require.Equal(t, `SELECT "host", count(*) FROM "main"."metrics" WHERE (value IS NOT NULL) ORDER BY "host" DESC`, sql)
+	})
+
+	for name, raw := range map[string]string{
+		"unknown column":    `{"columns": [{"parameters": [{"name": "host\"; DROP TABLE metrics; --"}]}]}`,
+		"unknown aggregate": `{"columns": [{"name": "pg_sleep", "parameters": [{"name": "value"}]}]}`,
+		"unknown operator":  `{"columns": [{"parameters": [{"name": "host"}]}], "whereFilters": [{"column": "host", "operator": "; --", "value": "a"}]}`,
+		"invalid interval":  `{"columns": [{"parameters": [{"name": "host"}]}], "groupBy": [{"property": {"name": "ts"}, "interval": "1h); --"}]}`,
+		"invalid direction": `{"columns": [{"parameters": [{"name": "host"}]}], "orderBy": {"property": {"name": "host"}}, "orderByDirection": "sideways"}`,
+		"unknown order-by":  `{"columns": [{"parameters": [{"name": "host"}]}], "orderBy": {"property": {"name": "nope"}}}`,
+		"no columns":        `{}`,
+	} {
+		t.Run("Should reject "+name, func(t *testing.T) {
+			_, err := compileBuilderQuery("main", "metrics", parse(t, raw), columns)
+			require.Error(t, err)
+		})
+	}
+
+	handler := newTestHandler(t, JsonData{},
+		"CREATE TABLE requests (host VARCHAR, status INTEGER)",
+		"INSERT INTO requests VALUES ('web-1', 200), ('web-2', 500), ('web-1', 404)",
+	)
+
+	t.Run("Should run builder queries without rawSql", func(t *testing.T) {
+		res := queryData(t, handler, backend.DataQuery{
+			RefID:     "A",
+			QueryType: queryTypeBuilder,
+			JSON: []byte(`{"format": "table", "table": "requests", "rawSql": "SELECT 'generated by the editor'", "sql": {
+				"columns": [{"type": "function", "name": "count", "alias": "requests", "parameters": [{"name": "status"}]}],
+				"groupBy": [{"type": "groupBy", "property": {"name": "host"}}],
+				"orderBy": {"property": {"name": "host"}}
+			}}`),
+		})
+		require.NoError(t, res.Error)
+		require.Equal(t, `SELECT "host", count("status") AS "requests" FROM "main"."requests" GROUP BY ALL ORDER BY "host"`, res.Frames[0].Meta.ExecutedQueryString)
+		require.Equal(t, 2, res.Frames[0].Rows())
+		require.Equal(t, "web-1", *res.Frames[0].Fields[0].At(0).(*string))
+		require.Equal(t, int64(2), *res.Frames[0].Fields[1].At(0).(*int64))
+
+		res = queryData(t, handler, backend.DataQuery{
+			RefID: "B",
+			JSON:  []byte(`{"format": "table", "table": "requests", "sql": {"columns": [{"parameters": [{"name": "status"}]}]}}`),
+		})
+		require.NoError(t, res.Error)
+		require.Equal(t, 3, res.Frames[0].Rows())
+	})
+
+	t.Run("Should fail builder queries on unknown tables", func(t *testing.T) {
+		res := queryData(t, handler, backend.DataQuery{
+			RefID:     "A",
+			QueryType: queryTypeBuilder,
+			JSON:      []byte(`{"format": "table", "table": "missing", "sql": {"columns": [{"parameters": [{"name": "status"}]}]}}`),
+		})
+		require.ErrorContains(t, res.Error, "unknown table")
+	})
+}
@@ -0,0 +1,203 @@
+package sqleng
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// maxChunks bounds the number of parts a time range is split into
+const maxChunks = 64
+
+// chunkTimeRanges splits the time range into n contiguous parts. The edges between the parts are aligned to the
+// alignment, so that a time group is never read by two parts, see timeGroupAlignment. Parts that become empty by the alignment are dropped.
+func chunkTimeRanges(timeRange backend.TimeRange, n int, alignment time.Duration) []backend.TimeRange {
+	n = min(n, maxChunks)
+	if n <= 1 || !timeRange.To.After(timeRange.From) {
+		return []backend.TimeRange{timeRange}
+	}
+
+	width := timeRange.To.Sub(timeRange.From) / time.Duration(n)
+	var ranges []backend.TimeRange
+	from := timeRange.From
+	for i := 1; i < n; i++ {
+		edge := timeRange.From.Add(time.Duration(i) * width)
+		if alignment > 0 {
+			edge = alignedStart(edge, alignment).In(timeRange.From.Location())
+		}
+		if !edge.After(from) || !edge.Before(timeRange.To) {
+			continue
+		}
+		ranges = append(ranges, backend.TimeRange{From: from, To: edge})
+		from = edge
+	}
+	return append(ranges, backend.TimeRange{From: from, To: timeRange.To})
+}
+
+// timeGroupAlignment returns the width the edges between chunks and cached buckets are aligned to: the widest time group of the
+// $__timeGroup and $__unixEpochGroup calls of the query, or the interval without any. It returns false when the
+// query can not be chunked without splitting a group: calendar units, time zones, origins and offsets, widths that
+// are no literal and widths that do not divide the widest one.
+func timeGroupAlignment(rawSQL string, interval time.Duration) (time.Duration, bool) {
+	var widths []time.Duration
+	for _, call := range FindMacroCalls(rawSQL) {
+		switch call.Name {
+		case "__timeGroup", "__timeGroupAlias", "__unixEpochGroup", "__unixEpochGroupAlias":
+		default:
+			continue
+		}
+		if len(call.Args) < 2 {
+			return 0, false
+		}
+		width := strings.Trim(strings.TrimSpace(call.Args[1]), `'`)
+		if strings.HasSuffix(width, "w") || strings.HasSuffix(width, "M") || strings.HasSuffix(width, "y") {
+			return 0, false
+		}
+		for _, arg := range call.Args[2:] {
+			arg = strings.TrimSpace(arg)
+			if strings.Contains(arg, "=") || strings.HasPrefix(arg, "'") || arg == "tz" {
+				return 0, false
+			}
+		}
+		duration, err := gtime.ParseInterval(width)
+		if err != nil || duration <= 0 {
+			return 0, false
+		}
+		widths = append(widths, duration)
+	}
+	if len(widths) == 0 {
+		return interval, true
+	}
+
+	alignment := slices.Max(widths)
+	for _, width := range widths {
+		if alignment%width != 0 {
+			return 0, false
+		}
+	}
+	return alignment, true
+}
+
+// acquireQuerySlot waits until fewer queries than the MaxOpenConns setting run, see DataSourceHandler.querySlots
+func (e *DataSourceHandler) acquireQuerySlot(ctx context.Context) (func(), error) {
+	if e.querySlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case e.querySlots <- struct{}{}:
+		return func() { <-e.querySlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runChunks runs the query on every chunk of its time range at once and concatenates the results in the order of
+// the chunks. A chunk and the next one both read the rows at the edge between them, the first chunk drops them.
+func (e *DataSourceHandler) runChunks(ctx context.Context, query backend.DataQuery, queryJson QueryJson) (*queryRun, error) {
+	alignment, ok := timeGroupAlignment(queryJson.RawSql, query.Interval)
+	if !ok {
+		return e.runQuery(ctx, query, queryJson)
+	}
+	ranges := chunkTimeRanges(query.TimeRange, queryJson.Chunks, alignment)
+	if len(ranges) == 1 || queryJson.Explain != "" {
+		return e.runQuery(ctx, query, queryJson)
+	}
+
+	runs := make([]*queryRun, len(ranges))
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for i, timeRange := range ranges {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					errs[i] = fmt.Errorf("chunk %d failed: %v", i, r)
+				}
+			}()
+
+			release, err := e.acquireQuerySlot(ctx)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer release()
+
+			chunk := query
+			chunk.TimeRange = timeRange
+			if query.MaxDataPoints > 0 {
+				// downsampled chunks return as many points together as the whole range
+				chunk.MaxDataPoints = max(query.MaxDataPoints/int64(len(ranges)), 1)
+			}
+			runs[i], errs[i] = e.runQuery(ctx, chunk, queryJson)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	merged := runs[0]
+	merged.query.TimeRange = query.TimeRange
+	merged.qm.TimeRange = backend.TimeRange{From: query.TimeRange.From.UTC(), To: query.TimeRange.To.UTC()}
+	for _, run := range runs {
+		// epoch times are converted first so that the edges can be found
+		if err := convertSQLTimeColumnsToEpochMS(run.frame, run.qm); err != nil {
+			return nil, &queryStageError{stage: "converting time columns failed", query: run.interpolatedQuery, err: err}
+		}
+	}
+	frame := merged.frame.EmptyCopy()
+	frame.Meta = merged.frame.Meta
+	executed := make([]string, len(runs))
+	for i, run := range runs {
+		end := time.Time{}
+		if i < len(runs)-1 {
+			end = ranges[i].To
+		}
+		if err := appendChunkFrame(frame, run.frame, merged.qm.timeIndex, end); err != nil {
+			return nil, &queryStageError{stage: "concatenating the chunks failed", query: run.interpolatedQuery, err: err}
+		}
+		executed[i] = run.interpolatedQuery
+	}
+
+	merged.interpolatedQuery = strings.Join(executed, ";\n")
+	merged.qm.InterpolatedQuery = merged.interpolatedQuery
+	frame.Meta.ExecutedQueryString = merged.interpolatedQuery
+	merged.frame = frame
+	return merged, nil
+}
+
+// appendChunkFrame appends the rows of a chunk to frame, except for the rows at the end of the chunk. A zero end
+// keeps every row.
+func appendChunkFrame(frame *data.Frame, chunk *data.Frame, timeIndex int, end time.Time) error {
+	if len(chunk.Fields) != len(frame.Fields) {
+		return fmt.Errorf("the chunks returned different columns")
+	}
+	for i, field := range chunk.Fields {
+		if field.Type() != frame.Fields[i].Type() {
+			return fmt.Errorf("column %q has different types in the chunks", field.Name)
+		}
+	}
+	for row := 0; row < chunk.Rows(); row++ {
+		if timeIndex != -1 && !end.IsZero() {
+			if t, ok := chunk.Fields[timeIndex].ConcreteAt(row); ok {
+				if t, ok := t.(time.Time); ok && t.Equal(end) {
+					continue
+				}
+			}
+		}
+		for i, field := range chunk.Fields {
+			frame.Fields[i].Append(field.CopyAt(row))
+		}
+	}
+	return nil
+}
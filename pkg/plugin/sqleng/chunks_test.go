@@ -0,0 +1,101 @@
+package sqleng
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunks(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("Should split the range at aligned edges", func(t *testing.T) {
+		ranges := chunkTimeRanges(backend.TimeRange{From: from.Add(10 * time.Minute), To: from.Add(4 * time.Hour)}, 3, time.Hour)
+		require.Equal(t, []backend.TimeRange{
+			{From: from.Add(10 * time.Minute), To: from.Add(time.Hour)},
+			{From: from.Add(time.Hour), To: from.Add(2 * time.Hour)},
+			{From: from.Add(2 * time.Hour), To: from.Add(4 * time.Hour)},
+		}, ranges)
+
+		// edges that collapse by the alignment are dropped
+		require.Len(t, chunkTimeRanges(backend.TimeRange{From: from, To: from.Add(time.Hour)}, 4, time.Hour), 1)
+		require.Len(t, chunkTimeRanges(backend.TimeRange{From: from, To: from.Add(time.Hour)}, 1, 0), 1)
+		require.Len(t, chunkTimeRanges(backend.TimeRange{From: from, To: from.Add(time.Hour)}, 1000, 0), maxChunks)
+	})
+
+	t.Run("Should align the edges to the widest time group", func(t *testing.T) {
+		alignment, ok := timeGroupAlignment("SELECT $__timeGroup(time, 1d), $__timeGroup(time, 6h, 0) FROM t", time.Hour)
+		require.True(t, ok)
+		require.Equal(t, 24*time.Hour, alignment)
+		alignment, ok = timeGroupAlignment("SELECT time FROM t", time.Hour)
+		require.True(t, ok)
+		require.Equal(t, time.Hour, alignment)
+
+		for _, rawSQL := range []string{
+			"SELECT $__timeGroup(time, 1M) FROM t",
+			"SELECT $__timeGroup(time, 1d, 'Europe/Berlin') FROM t",
+			"SELECT $__timeGroup(time, 1d, offset='6h') FROM t",
+			"SELECT $__timeGroup(time, $width()) FROM t",
+			"SELECT $__timeGroup(time, 1d), $__unixEpochGroup(epoch, 7h) FROM t",
+		} {
+			_, ok := timeGroupAlignment(rawSQL, time.Hour)
+			require.False(t, ok, rawSQL)
+		}
+
+		// a day split in hours would return two partial rows for the same day
+		ranges := chunkTimeRanges(backend.TimeRange{From: from, To: from.Add(72 * time.Hour)}, 3, 24*time.Hour)
+		require.Equal(t, []backend.TimeRange{
+			{From: from, To: from.Add(24 * time.Hour)},
+			{From: from.Add(24 * time.Hour), To: from.Add(48 * time.Hour)},
+			{From: from.Add(48 * time.Hour), To: from.Add(72 * time.Hour)},
+		}, ranges)
+	})
+
+	for name, maxOpenConns := range map[string]int{"unbounded": 0, "one at a time": 1} {
+		handler := newTestHandler(t, JsonData{MaxOpenConns: maxOpenConns},
+			"CREATE TABLE metrics AS SELECT TIMESTAMP '2024-01-01' + to_minutes(i) AS time, i AS value FROM range(0, 600) t(i)",
+		)
+
+		query := func(t *testing.T, rawSQL string, chunks int) backend.DataResponse {
+			return queryData(t, handler, backend.DataQuery{
+				Interval:  time.Hour,
+				TimeRange: backend.TimeRange{From: from, To: from.Add(5 * time.Hour)},
+				JSON:      []byte(`{"rawSql": "` + rawSQL + `", "format": "time_series", "chunks": ` + strconv.Itoa(chunks) + `}`),
+			})
+		}
+		values := func(frame *data.Frame) []any {
+			var result []any
+			for _, field := range frame.Fields {
+				for i := 0; i < field.Len(); i++ {
+					result = append(result, field.At(i))
+				}
+			}
+			return result
+		}
+
+		t.Run("Should return the same rows as one query, "+name, func(t *testing.T) {
+			for _, rawSQL := range []string{
+				"SELECT time, value FROM metrics WHERE epoch(time) BETWEEN $__unixEpochFrom() AND $__unixEpochTo() ORDER BY time",
+				"SELECT time_bucket(INTERVAL 1 hour, time) AS time, count(*) AS value FROM metrics WHERE epoch(time) BETWEEN $__unixEpochFrom() AND $__unixEpochTo() GROUP BY 1 ORDER BY 1",
+				"SELECT floor(epoch(time) / 3600) * 3600 AS time, count(*) AS value FROM metrics WHERE epoch(time) BETWEEN $__unixEpochFrom() AND $__unixEpochTo() GROUP BY 1 ORDER BY 1",
+			} {
+				whole := query(t, rawSQL, 1)
+				require.NoError(t, whole.Error)
+				chunked := query(t, rawSQL, 4)
+				require.NoError(t, chunked.Error)
+				require.Equal(t, values(whole.Frames[0]), values(chunked.Frames[0]))
+				require.Len(t, strings.Split(chunked.Frames[0].Meta.ExecutedQueryString, ";\n"), 4)
+			}
+		})
+
+		t.Run("Should fail when a chunk fails, "+name, func(t *testing.T) {
+			resp := query(t, "SELECT time, value FROM metrics WHERE CASE WHEN $__unixEpochFrom() > 1704067200 THEN error('chunk failed') ELSE true END", 4)
+			require.ErrorContains(t, resp.Error, "chunk failed")
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package sqleng
+
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// headerFromAlert is set by Grafana on requests of alert rule evaluations
+const headerFromAlert = "FromAlert"
+
+// dataplaneTypeVersion is the version of the dataplane contract the frame types follow, logsTypeVersion the one
+// of the logs contract
+var (
+	dataplaneTypeVersion = data.FrameTypeVersion{0, 1}
+	logsTypeVersion      = data.FrameTypeVersion{0, 0}
+)
+
+// seriesShapeLong keeps long time series long instead of converting them to wide ones
+const seriesShapeLong = "long"
+
+func isFromAlert(req *backend.QueryDataRequest) bool {
+	return req.Headers[headerFromAlert] == "true" || req.GetHTTPHeader(headerFromAlert) == "true"
+}
+
+func setFrameType(frame *data.Frame, frameType data.FrameType) {
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	frame.Meta.Type = frameType
+	frame.Meta.TypeVersion = dataplaneTypeVersion
+	if frameType == data.FrameTypeLogLines {
+		frame.Meta.TypeVersion = logsTypeVersion
+	}
+}
+
+// emptyFrameType is the frame type of a result without rows, which is still typed so that alerting can tell "no
+// data" from an unknown shape
+func emptyFrameType(format dataQueryFormat, fromAlert bool, long bool) data.FrameType {
+	switch format {
+	case dataQueryFormatSeries:
+		if fromAlert {
+			return data.FrameTypeTimeSeriesMulti
+		}
+		if long {
+			return data.FrameTypeTimeSeriesLong
+		}
+		return data.FrameTypeTimeSeriesWide
+	case dataQueryFormatLogs:
+		return data.FrameTypeLogLines
+	case dataQueryFormatHeatmap:
+		return frameTypeHeatmapRows
+	default:
+		return data.FrameTypeTable
+	}
+}
+
+// toNumericFrame converts a time-less aggregate to numeric data: a single row of numbers is numeric-wide, anything
+// else numeric-long with the string columns as dimensions.
+func toNumericFrame(frame *data.Frame) (*data.Frame, error) {
+	hasStrings := false
+	for i, field := range frame.Fields {
+		if isStringField(field) {
+			hasStrings = true
+			continue
+		}
+
+		var err error
+		if frame, err = convertSQLValueColumnToFloat(frame, i); err != nil {
+			return nil, err
+		}
+	}
+
+	if frame.Rows() == 1 && !hasStrings {
+		setFrameType(frame, data.FrameTypeNumericWide)
+	} else {
+		setFrameType(frame, data.FrameTypeNumericLong)
+	}
+	return frame, nil
+}
+
+// toTimeSeriesMulti splits a wide time series into one frame per numeric value field, the shape alerting reduces
+// per series. Every frame shares the time field of the wide frame, other fields are dropped.
+func toTimeSeriesMulti(frame *data.Frame) data.Frames {
+	timeIndices := frame.TypeIndices(data.FieldTypeTime, data.FieldTypeNullableTime)
+	if len(timeIndices) == 0 {
+		setFrameType(frame, data.FrameTypeTimeSeriesMulti)
+		return data.Frames{frame}
+	}
+	timeField := frame.Fields[timeIndices[0]]
+
+	var frames data.Frames
+	for i, field := range frame.Fields {
+		if i == timeIndices[0] || !field.Type().Numeric() {
+			continue
+		}
+		series := data.NewFrame(frame.Name, timeField, field)
+		if frame.Meta != nil {
+			meta := *frame.Meta
+			series.Meta = &meta
+		}
+		setFrameType(series, data.FrameTypeTimeSeriesMulti)
+		frames = append(frames, series)
+	}
+	if len(frames) == 0 {
+		// a time field alone is still a valid, empty, multi frame response
+		setFrameType(frame, data.FrameTypeTimeSeriesMulti)
+		return data.Frames{frame}
+	}
+	return frames
+}
+
+// toTimeSeriesLong converts a wide time series back to a long one, with a row per time and series and the labels
+// as string columns
+func toTimeSeriesLong(frame *data.Frame) (*data.Frame, error) {
+	long, err := data.WideToLong(frame)
+	if err != nil {
+		return nil, err
+	}
+	long.Meta = frame.Meta
+	setFrameType(long, data.FrameTypeTimeSeriesLong)
+	return long, nil
+}
+
+// frameCustomMeta is the datasource specific part of the frame meta
+type frameCustomMeta struct {
+	// TimeShift is the shift of the query, e.g. "7d". The times of the frame were moved forward by it.
+	TimeShift string `json:"timeShift,omitempty"`
+	// RollupTables are the tables $__rollupTable chose, by base table
+	RollupTables map[string]string `json:"rollupTables,omitempty"`
+	// YMatchWithLabel is the label holding the bucket bound of heatmap-rows frames
+	YMatchWithLabel string `json:"yMatchWithLabel,omitempty"`
+	// Snapshot is the snapshot of the database directory the query ran on
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+func (c frameCustomMeta) isEmpty() bool {
+	return c.TimeShift == "" && len(c.RollupTables) == 0 && c.YMatchWithLabel == "" && c.Snapshot == ""
+}
+
+// setCustomMeta records the custom meta on every frame
+func setCustomMeta(frames data.Frames, custom frameCustomMeta) {
+	if custom.isEmpty() {
+		return
+	}
+	for _, frame := range frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		frame.Meta.Custom = custom
+	}
+}
+
+// appendNotices adds the notices to every frame
+func appendNotices(frames data.Frames, notices []data.Notice) {
+	if len(notices) == 0 {
+		return
+	}
+	for _, frame := range frames {
+		frame.AppendNotices(notices...)
+	}
+}
@@ -0,0 +1,94 @@
+package sqleng
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataplaneFrameTypes(t *testing.T) {
+	handler := newTestHandler(t, JsonData{},
+		"CREATE TABLE metrics (time TIMESTAMP, host VARCHAR, value DOUBLE)",
+		`INSERT INTO metrics VALUES
+			('2024-01-01 00:00:00', 'a', 1), ('2024-01-01 00:00:00', 'b', 2),
+			('2024-01-01 00:01:00', 'a', 3), ('2024-01-01 00:01:00', 'b', 4)`,
+	)
+
+	query := func(t *testing.T, headers map[string]string, rawSql string, format string, options ...string) data.Frames {
+		resp := queryData(t, handler, backend.DataQuery{JSON: []byte(`{"rawSql": "` + rawSql + `", "format": "` + format + `"` + strings.Join(options, "") + `}`)}, headers)
+		require.NoError(t, resp.Error)
+		return resp.Frames
+	}
+
+	t.Run("Should stamp tables", func(t *testing.T) {
+		frames := query(t, nil, "SELECT * FROM metrics", "table")
+		require.Equal(t, data.FrameTypeTable, frames[0].Meta.Type)
+		require.Equal(t, data.FrameTypeVersion{0, 1}, frames[0].Meta.TypeVersion)
+	})
+
+	t.Run("Should stamp wide time series", func(t *testing.T) {
+		frames := query(t, nil, "SELECT * FROM metrics ORDER BY time", "time_series")
+		require.Len(t, frames, 1)
+		require.Equal(t, data.FrameTypeTimeSeriesWide, frames[0].Meta.Type)
+		require.Len(t, frames[0].Fields, 3)
+	})
+
+	t.Run("Should return one frame per series to alerting", func(t *testing.T) {
+		frames := query(t, map[string]string{headerFromAlert: "true"}, "SELECT * FROM metrics ORDER BY time", "time_series")
+		require.Len(t, frames, 2)
+		for _, frame := range frames {
+			require.Equal(t, data.FrameTypeTimeSeriesMulti, frame.Meta.Type)
+			require.Len(t, frame.Fields, 2)
+			require.Equal(t, 2, frame.Rows())
+		}
+		require.Equal(t, data.Labels{"host": "b"}, frames[1].Fields[1].Labels)
+	})
+
+	t.Run("Should keep long time series long when asked to", func(t *testing.T) {
+		frames := query(t, nil, "SELECT * FROM metrics ORDER BY time", "time_series", `, "seriesShape": "long"`)
+		require.Len(t, frames, 1)
+		require.Equal(t, data.FrameTypeTimeSeriesLong, frames[0].Meta.Type)
+		require.Equal(t, []string{"Time", "value", "host"}, fieldNames(frames[0]))
+		require.Equal(t, 4, frames[0].Rows())
+
+		frames = query(t, nil, "SELECT * FROM metrics WHERE value > 100", "time_series", `, "seriesShape": "long"`)
+		require.Equal(t, data.FrameTypeTimeSeriesLong, frames[0].Meta.Type)
+	})
+
+	t.Run("Should leave string fields out of the series for alerting", func(t *testing.T) {
+		frames := toTimeSeriesMulti(data.NewFrame("",
+			data.NewField("Time", nil, []time.Time{time.Unix(0, 0)}),
+			data.NewField("note", nil, []*string{Pointer("deploy")}),
+			data.NewField("value", nil, []*float64{Pointer(1.0)}),
+		))
+		require.Len(t, frames, 1)
+		require.Equal(t, []string{"Time", "value"}, fieldNames(frames[0]))
+	})
+
+	t.Run("Should version empty logs frames like other logs frames", func(t *testing.T) {
+		frames := query(t, nil, "SELECT time, host AS body FROM metrics WHERE value > 100", "logs")
+		require.Equal(t, data.FrameTypeLogLines, frames[0].Meta.Type)
+		require.Equal(t, data.FrameTypeVersion{0, 0}, frames[0].Meta.TypeVersion)
+		frames = query(t, nil, "SELECT time, host AS body FROM metrics", "logs")
+		require.Equal(t, data.FrameTypeVersion{0, 0}, frames[0].Meta.TypeVersion)
+	})
+
+	t.Run("Should return time-less aggregates as numeric data", func(t *testing.T) {
+		frames := query(t, nil, "SELECT sum(value) AS total, count(*) AS n FROM metrics", "time_series")
+		require.Equal(t, data.FrameTypeNumericWide, frames[0].Meta.Type)
+		require.Equal(t, 10.0, *frames[0].Fields[0].At(0).(*float64))
+
+		frames = query(t, nil, "SELECT host, sum(value) AS total FROM metrics GROUP BY host ORDER BY host", "time_series")
+		require.Equal(t, data.FrameTypeNumericLong, frames[0].Meta.Type)
+		require.Equal(t, 2, frames[0].Rows())
+	})
+
+	t.Run("Should type empty results", func(t *testing.T) {
+		frames := query(t, map[string]string{headerFromAlert: "true"}, "SELECT * FROM metrics WHERE value > 100", "time_series")
+		require.Equal(t, data.FrameTypeTimeSeriesMulti, frames[0].Meta.Type)
+	})
+}
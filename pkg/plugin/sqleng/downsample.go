@@ -0,0 +1,221 @@
+package sqleng
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Downsampling methods. Min/max keeps the lowest and the highest row of every bucket. LTTB reduces to twice as
+// many min/max buckets in DuckDB and picks the final points with largest-triangle-three-buckets (MinMaxLTTB).
+const (
+	downsampleMinMax = "minmax"
+	downsampleLTTB   = "lttb"
+)
+
+// defaultMaxDataPoints is used when the request does not say how many points the panel can show
+const defaultMaxDataPoints = 1000
+
+var downsampleTimeTypes = map[string]bool{
+	"TIMESTAMP":                true,
+	"TIMESTAMP WITH TIME ZONE": true,
+	"TIMESTAMP_S":              true,
+	"TIMESTAMP_MS":             true,
+	"TIMESTAMP_NS":             true,
+	"DATE":                     true,
+}
+
+var downsampleValueTypes = map[string]bool{
+	"TINYINT":   true,
+	"SMALLINT":  true,
+	"INTEGER":   true,
+	"BIGINT":    true,
+	"HUGEINT":   true,
+	"UTINYINT":  true,
+	"USMALLINT": true,
+	"UINTEGER":  true,
+	"UBIGINT":   true,
+	"FLOAT":     true,
+	"DOUBLE":    true,
+}
+
+func isDownsampleValueType(columnType string) bool {
+	return downsampleValueTypes[columnType] || strings.HasPrefix(columnType, "DECIMAL")
+}
+
+// downsampleBuckets is the number of buckets the time range is divided into
+func downsampleBuckets(method string, maxDataPoints int64) int64 {
+	if maxDataPoints <= 0 {
+		maxDataPoints = defaultMaxDataPoints
+	}
+	if method == downsampleLTTB {
+		// LTTB picks from at most four candidates per final point
+		return maxDataPoints * 2
+	}
+	// every bucket returns up to two rows
+	return max(maxDataPoints/2, 1)
+}
+
+// downsampleQuery wraps the query so that only the rows holding the minimum or the maximum of a numeric column
+// within their time bucket are returned. Buckets are kept apart per string column, the labels of the series.
+func downsampleQuery(query string, method string, timeColumns []string, columns []describedColumn, timeRange backend.TimeRange, maxDataPoints int64) (string, error) {
+	if method != downsampleMinMax && method != downsampleLTTB {
+		return "", fmt.Errorf("unsupported downsample method %q", method)
+	}
+
+	var timeColumn, timeType string
+	var values, labels []string
+	for _, column := range columns {
+		switch {
+		case timeColumn == "" && slices.Contains(timeColumns, column.name):
+			timeColumn, timeType = column.name, column.columnType
+		case isDownsampleValueType(column.columnType):
+			values = append(values, quoteIdentifier(column.name))
+		case column.columnType == "VARCHAR" || strings.HasPrefix(column.columnType, "ENUM"):
+			labels = append(labels, quoteIdentifier(column.name))
+		}
+	}
+	if !downsampleTimeTypes[timeType] {
+		return "", fmt.Errorf("downsampling needs a time column of a timestamp type")
+	}
+	if len(values) == 0 {
+		// nothing to reduce
+		return query, nil
+	}
+
+	buckets := downsampleBuckets(method, maxDataPoints)
+	width := max(timeRange.To.Sub(timeRange.From).Milliseconds()/buckets, 1)
+	bucket := fmt.Sprintf("(epoch_ms(CAST(%s AS TIMESTAMP)) - %d) // %d", quoteIdentifier(timeColumn), timeRange.From.UnixMilli(), width)
+
+	partition := strings.Join(append(append([]string{}, labels...), "downsample_bucket"), ", ")
+	var ranks, conditions, helpers []string
+	for i, value := range values {
+		for _, direction := range []string{"ASC", "DESC"} {
+			name := fmt.Sprintf("downsample_rank_%d_%s", i, strings.ToLower(direction))
+			ranks = append(ranks, fmt.Sprintf("row_number() OVER (PARTITION BY %s ORDER BY %s %s NULLS LAST, %s) AS %s",
+				partition, value, direction, quoteIdentifier(timeColumn), name))
+			conditions = append(conditions, name+" = 1")
+			helpers = append(helpers, name)
+		}
+	}
+
+	return fmt.Sprintf("SELECT * EXCLUDE (downsample_bucket, %s) FROM (SELECT *, %s FROM (SELECT *, %s AS downsample_bucket FROM (%s) AS downsample_source) AS downsample_buckets) AS downsample_ranks WHERE %s ORDER BY %s",
+		strings.Join(helpers, ", "), strings.Join(ranks, ", "), bucket, strings.TrimRight(strings.TrimSpace(query), ";"),
+		strings.Join(conditions, " OR "), quoteIdentifier(timeColumn)), nil
+}
+
+// lttbFrame reduces a wide time series frame to at most threshold points with largest-triangle-three-buckets.
+// Every value field picks its points from an equal share of the threshold and the frame keeps the rows picked by
+// any of them, as the series share the time field. Frames of another shape are returned as they are.
+func lttbFrame(frame *data.Frame, threshold int) *data.Frame {
+	if threshold <= 0 {
+		threshold = defaultMaxDataPoints
+	}
+	timeIndices := frame.TypeIndices(data.FieldTypeTime, data.FieldTypeNullableTime)
+	if len(timeIndices) != 1 || frame.Rows() <= threshold {
+		return frame
+	}
+	timeField := frame.Fields[timeIndices[0]]
+	var valueFields []*data.Field
+	for i, field := range frame.Fields {
+		if i != timeIndices[0] && field.Type().Numeric() {
+			valueFields = append(valueFields, field)
+		}
+	}
+	if len(valueFields) == 0 || threshold/len(valueFields) < 3 {
+		return frame
+	}
+
+	xs := make([]float64, frame.Rows())
+	for i := range xs {
+		t, ok := timeField.ConcreteAt(i)
+		if !ok {
+			return frame
+		}
+		xs[i] = float64(t.(time.Time).UnixNano())
+	}
+
+	picked := make([]bool, frame.Rows())
+	ys := make([]float64, frame.Rows())
+	for _, field := range valueFields {
+		for i := range ys {
+			v, err := field.NullableFloatAt(i)
+			if err != nil {
+				return frame
+			}
+			if v == nil {
+				ys[i] = math.NaN()
+			} else {
+				ys[i] = *v
+			}
+		}
+		for _, row := range lttb(xs, ys, threshold/len(valueFields)) {
+			picked[row] = true
+		}
+	}
+
+	reduced := frame.EmptyCopy()
+	reduced.Meta = frame.Meta
+	for row, ok := range picked {
+		if ok {
+			reduced.AppendRow(frame.RowCopy(row)...)
+		}
+	}
+	return reduced
+}
+
+// lttb returns the indexes of the points picked by largest-triangle-three-buckets. The first and the last point
+// are always kept. Null values (NaN) are never picked unless a bucket holds nothing else.
+func lttb(xs []float64, ys []float64, threshold int) []int {
+	n := len(xs)
+	picked := make([]int, 0, threshold)
+	picked = append(picked, 0)
+
+	every := float64(n-2) / float64(threshold-2)
+	a := 0
+	for i := 0; i < threshold-2; i++ {
+		// the average of the next bucket is the third corner of the triangle
+		nextStart := int(math.Floor(float64(i+1)*every)) + 1
+		nextEnd := min(int(math.Floor(float64(i+2)*every))+1, n)
+		avgX, avgY, count := 0.0, 0.0, 0.0
+		for j := nextStart; j < nextEnd; j++ {
+			if math.IsNaN(ys[j]) {
+				continue
+			}
+			avgX += xs[j]
+			avgY += ys[j]
+			count++
+		}
+		if count > 0 {
+			avgX /= count
+			avgY /= count
+		} else {
+			avgX, avgY = xs[n-1], ys[n-1]
+		}
+
+		start := int(math.Floor(float64(i)*every)) + 1
+		end := int(math.Floor(float64(i+1)*every)) + 1
+		best, bestArea := start, -1.0
+		for j := start; j < end; j++ {
+			if math.IsNaN(ys[j]) {
+				continue
+			}
+			area := math.Abs((xs[a]-avgX)*(ys[j]-ys[a]) - (xs[a]-xs[j])*(avgY-ys[a]))
+			if math.IsNaN(area) {
+				// the previous point is null, fall back to the height of the point
+				area = math.Abs(ys[j] - avgY)
+			}
+			if area > bestArea {
+				best, bestArea = j, area
+			}
+		}
+		picked = append(picked, best)
+		a = best
+	}
+	return append(picked, n-1)
+}
@@ -0,0 +1,119 @@
+package sqleng
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownsample(t *testing.T) {
+	t.Run("Should keep the first, the last and the extreme points with LTTB", func(t *testing.T) {
+		xs := make([]float64, 100)
+		ys := make([]float64, 100)
+		for i := range xs {
+			xs[i] = float64(i)
+		}
+		ys[42] = 100
+		ys[77] = -50
+		ys[10] = math.NaN()
+
+		picked := lttb(xs, ys, 10)
+		require.Len(t, picked, 10)
+		require.Equal(t, 0, picked[0])
+		require.Equal(t, 99, picked[9])
+		require.Contains(t, picked, 42)
+		require.Contains(t, picked, 77)
+		require.NotContains(t, picked, 10)
+	})
+
+	t.Run("Should keep the points every series picks", func(t *testing.T) {
+		times := make([]time.Time, 100)
+		a := make([]float64, 100)
+		b := make([]*float64, 100)
+		for i := range times {
+			times[i] = time.Unix(int64(i), 0)
+			b[i] = Pointer(0.0)
+		}
+		a[42] = 100
+		b[77] = Pointer(-50.0)
+		b[10] = nil
+		frame := data.NewFrame("", data.NewField("time", nil, times), data.NewField("a", nil, a), data.NewField("b", nil, b))
+
+		reduced := lttbFrame(frame, 20)
+		require.LessOrEqual(t, reduced.Rows(), 20)
+		var kept []int64
+		for i := 0; i < reduced.Rows(); i++ {
+			kept = append(kept, reduced.Fields[0].At(i).(time.Time).Unix())
+		}
+		require.Contains(t, kept, int64(42))
+		require.Contains(t, kept, int64(77))
+		require.Equal(t, 100.0, reduced.Fields[1].At(slices.Index(kept, 42)))
+		require.Equal(t, -50.0, *reduced.Fields[2].At(slices.Index(kept, 77)).(*float64))
+
+		require.Same(t, frame, lttbFrame(frame, 5))
+	})
+
+	t.Run("Should reject unknown methods and missing time columns", func(t *testing.T) {
+		columns := []describedColumn{{name: "time", columnType: "TIMESTAMP"}, {name: "value", columnType: "DOUBLE"}}
+		_, err := downsampleQuery("SELECT 1", "average", []string{"time"}, columns, backend.TimeRange{}, 100)
+		require.Error(t, err)
+		_, err = downsampleQuery("SELECT 1", downsampleMinMax, []string{"time"}, columns[1:], backend.TimeRange{}, 100)
+		require.Error(t, err)
+	})
+
+	handler := newTestHandler(t, JsonData{},
+		"CREATE TABLE metrics AS SELECT TIMESTAMP '2024-01-01' + to_seconds(i) AS time, host, CASE WHEN i = 4321 THEN 1000.0 ELSE sin(i / 100) END AS value FROM range(0, 10000) t(i), (VALUES ('a'), ('b')) hosts(host)",
+	)
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	query := func(t *testing.T, rawSql string, method string) data.Frames {
+		resp := queryData(t, handler, backend.DataQuery{
+			MaxDataPoints: 100,
+			TimeRange:     backend.TimeRange{From: from, To: from.Add(10000 * time.Second)},
+			JSON:          []byte(`{"rawSql": "` + rawSql + `", "format": "time_series", "downsample": "` + method + `"}`),
+		})
+		require.NoError(t, resp.Error)
+		return resp.Frames
+	}
+
+	maxValue := func(field *data.Field) float64 {
+		m := math.Inf(-1)
+		for i := 0; i < field.Len(); i++ {
+			if v := field.At(i).(*float64); v != nil {
+				m = math.Max(m, *v)
+			}
+		}
+		return m
+	}
+
+	t.Run("Should bound the rows per series and keep the peaks with min/max", func(t *testing.T) {
+		frames := query(t, "SELECT time, host, value FROM metrics ORDER BY time", downsampleMinMax)
+		frame := frames[0]
+		require.Len(t, frame.Fields, 3)
+		require.LessOrEqual(t, frame.Rows(), 2*100)
+		require.Greater(t, frame.Rows(), 50)
+		require.Equal(t, 1000.0, maxValue(frame.Fields[1]))
+		require.Equal(t, 1000.0, maxValue(frame.Fields[2]))
+	})
+
+	t.Run("Should reduce several series to MaxDataPoints with LTTB", func(t *testing.T) {
+		frames := query(t, "SELECT time, host, value FROM metrics ORDER BY time", downsampleLTTB)
+		require.Len(t, frames[0].Fields, 3)
+		require.LessOrEqual(t, frames[0].Rows(), 100)
+		require.GreaterOrEqual(t, frames[0].Rows(), 50)
+		require.Equal(t, 1000.0, maxValue(frames[0].Fields[1]))
+		require.Equal(t, 1000.0, maxValue(frames[0].Fields[2]))
+	})
+
+	t.Run("Should reduce a single series to MaxDataPoints with LTTB", func(t *testing.T) {
+		frames := query(t, "SELECT time, value FROM metrics WHERE host = 'a' ORDER BY time", downsampleLTTB)
+		require.Equal(t, 100, frames[0].Rows())
+		require.Contains(t, frames[0].Meta.ExecutedQueryString, "downsample_rank")
+		require.Equal(t, 1000.0, maxValue(frames[0].Fields[1]))
+	})
+}
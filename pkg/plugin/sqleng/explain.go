@@ -0,0 +1,245 @@
+package sqleng
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	explainModePlan    = "plan"
+	explainModeAnalyze = "analyze"
+)
+
+// explainNode is an operator of a DuckDB JSON plan. EXPLAIN uses "name", EXPLAIN ANALYZE uses "operator_type" and
+// adds the measured values.
+type explainNode struct {
+	Name         string                     `json:"name"`
+	OperatorType string                     `json:"operator_type"`
+	Cardinality  *int64                     `json:"operator_cardinality"`
+	Timing       *float64                   `json:"operator_timing"`
+	RowsScanned  *int64                     `json:"operator_rows_scanned"`
+	ExtraInfo    map[string]json.RawMessage `json:"extra_info"`
+	Children     []explainNode              `json:"children"`
+}
+
+func (n *explainNode) operator() string {
+	if n.Name != "" {
+		return strings.TrimSpace(n.Name)
+	}
+	return strings.TrimSpace(n.OperatorType)
+}
+
+// isWrapper reports whether the node is part of the profiling output rather than the plan of the query
+func (n *explainNode) isWrapper() bool {
+	switch n.operator() {
+	case "", "INVALID", "QUERY", "EXPLAIN_ANALYZE":
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *explainNode) estimatedCardinality() *int64 {
+	raw, ok := n.ExtraInfo["Estimated Cardinality"]
+	if !ok {
+		return nil
+	}
+	v, err := strconv.ParseInt(strings.TrimPrefix(formatExtraInfoValue(raw), "~"), 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+func (n *explainNode) extraInfo() string {
+	keys := make([]string, 0, len(n.ExtraInfo))
+	for key := range n.ExtraInfo {
+		if key != "Estimated Cardinality" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key + ": " + formatExtraInfoValue(n.ExtraInfo[key])
+	}
+	return strings.Join(parts, "; ")
+}
+
+// formatExtraInfoValue flattens the string or list-of-strings values DuckDB puts into extra_info
+func formatExtraInfoValue(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return strings.Join(list, ", ")
+	}
+	return string(raw)
+}
+
+// explainStatement prefixes the query with the EXPLAIN variant matching the mode.
+func explainStatement(mode string, query string) (string, error) {
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	switch mode {
+	case explainModePlan:
+		return "EXPLAIN (FORMAT JSON) " + query, nil
+	case explainModeAnalyze:
+		return "EXPLAIN (ANALYZE, FORMAT JSON) " + query, nil
+	default:
+		return "", fmt.Errorf("unknown explain mode %q, expected %q or %q", mode, explainModePlan, explainModeAnalyze)
+	}
+}
+
+// explainQuery runs the query under EXPLAIN or EXPLAIN ANALYZE and returns the operator tree as a table frame. The
+// rendered plan is attached as a notice so that it shows up in the query inspector.
+func (e *DataSourceHandler) explainQuery(ctx context.Context, db *sql.DB, mode string, query string) (*data.Frame, error) {
+	statement, err := explainStatement(mode, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var key, value string
+	if err := db.QueryRowContext(ctx, statement).Scan(&key, &value); err != nil {
+		return nil, err
+	}
+
+	roots, err := parseExplainPlan(value)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := newExplainFrame(roots, mode == explainModeAnalyze)
+	frame.Meta = &data.FrameMeta{
+		ExecutedQueryString:    statement,
+		PreferredVisualization: data.VisTypeTable,
+	}
+	frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityInfo, Text: renderExplainPlan(roots, mode == explainModeAnalyze)})
+	return frame, nil
+}
+
+// parseExplainPlan accepts both the list of roots returned by EXPLAIN and the single profiling root returned by
+// EXPLAIN ANALYZE, and strips the profiling wrapper nodes.
+func parseExplainPlan(value string) ([]explainNode, error) {
+	var nodes []explainNode
+	if err := json.Unmarshal([]byte(value), &nodes); err != nil {
+		var root explainNode
+		if err := json.Unmarshal([]byte(value), &root); err != nil {
+			return nil, fmt.Errorf("failed to parse plan: %w", err)
+		}
+		nodes = []explainNode{root}
+	}
+
+	var unwrap func(nodes []explainNode) []explainNode
+	unwrap = func(nodes []explainNode) []explainNode {
+		var result []explainNode
+		for _, node := range nodes {
+			if node.isWrapper() {
+				result = append(result, unwrap(node.Children)...)
+			} else {
+				result = append(result, node)
+			}
+		}
+		return result
+	}
+	return unwrap(nodes), nil
+}
+
+func newExplainFrame(roots []explainNode, analyze bool) *data.Frame {
+	id := data.NewFieldFromFieldType(data.FieldTypeInt64, 0)
+	id.Name = "id"
+	parentID := data.NewFieldFromFieldType(data.FieldTypeNullableInt64, 0)
+	parentID.Name = "parent_id"
+	depth := data.NewFieldFromFieldType(data.FieldTypeInt64, 0)
+	depth.Name = "depth"
+	operator := data.NewFieldFromFieldType(data.FieldTypeString, 0)
+	operator.Name = "operator"
+	estimated := data.NewFieldFromFieldType(data.FieldTypeNullableInt64, 0)
+	estimated.Name = "estimated_cardinality"
+	actual := data.NewFieldFromFieldType(data.FieldTypeNullableInt64, 0)
+	actual.Name = "actual_cardinality"
+	scanned := data.NewFieldFromFieldType(data.FieldTypeNullableInt64, 0)
+	scanned.Name = "rows_scanned"
+	timing := data.NewFieldFromFieldType(data.FieldTypeNullableFloat64, 0)
+	timing.Name = "timing_ms"
+	timing.Config = &data.FieldConfig{Unit: "ms"}
+	extra := data.NewFieldFromFieldType(data.FieldTypeString, 0)
+	extra.Name = "extra_info"
+
+	var nextID int64
+	var walk func(node explainNode, parent *int64, level int64)
+	walk = func(node explainNode, parent *int64, level int64) {
+		nodeID := nextID
+		nextID++
+		id.Append(nodeID)
+		parentID.Append(parent)
+		depth.Append(level)
+		operator.Append(node.operator())
+		estimated.Append(node.estimatedCardinality())
+		actual.Append(node.Cardinality)
+		scanned.Append(node.RowsScanned)
+		if node.Timing != nil {
+			ms := *node.Timing * 1000
+			timing.Append(&ms)
+		} else {
+			timing.Append(nil)
+		}
+		extra.Append(node.extraInfo())
+		for _, child := range node.Children {
+			walk(child, &nodeID, level+1)
+		}
+	}
+	for _, root := range roots {
+		walk(root, nil, 0)
+	}
+
+	if !analyze {
+		return data.NewFrame("plan", id, parentID, depth, operator, estimated, extra)
+	}
+	return data.NewFrame("plan", id, parentID, depth, operator, estimated, actual, scanned, timing, extra)
+}
+
+// renderExplainPlan renders the operator tree as indented text.
+func renderExplainPlan(roots []explainNode, analyze bool) string {
+	var sb strings.Builder
+	var walk func(node explainNode, level int)
+	walk = func(node explainNode, level int) {
+		sb.WriteString(strings.Repeat("  ", level))
+		sb.WriteString(node.operator())
+
+		var details []string
+		if estimated := node.estimatedCardinality(); estimated != nil {
+			details = append(details, fmt.Sprintf("estimated=%d", *estimated))
+		}
+		if analyze && node.Cardinality != nil {
+			details = append(details, fmt.Sprintf("actual=%d", *node.Cardinality))
+		}
+		if analyze && node.Timing != nil {
+			details = append(details, fmt.Sprintf("time=%.3fms", *node.Timing*1000))
+		}
+		if len(details) > 0 {
+			sb.WriteString(" (" + strings.Join(details, ", ") + ")")
+		}
+		if extra := node.extraInfo(); extra != "" {
+			sb.WriteString(" [" + extra + "]")
+		}
+		sb.WriteString("\n")
+
+		for _, child := range node.Children {
+			walk(child, level+1)
+		}
+	}
+	for _, root := range roots {
+		walk(root, 0)
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
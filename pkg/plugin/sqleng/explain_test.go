@@ -0,0 +1,51 @@
+package sqleng
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	handler := newTestHandler(t, JsonData{},
+		"CREATE TABLE metrics AS SELECT range AS i FROM range(1000)",
+	)
+
+	query := func(t *testing.T, mode string) backend.DataResponse {
+		return queryData(t, handler, backend.DataQuery{
+			JSON: []byte(`{"rawSql": "SELECT i % 10 AS bucket, count(*) FROM metrics GROUP BY 1;", "format": "table", "explain": "` + mode + `"}`),
+		})
+	}
+
+	t.Run("Should return the estimated plan", func(t *testing.T) {
+		res := query(t, "plan")
+		require.NoError(t, res.Error)
+		frame := res.Frames[0]
+		require.Equal(t, []string{"id", "parent_id", "depth", "operator", "estimated_cardinality", "extra_info"}, fieldNames(frame))
+		require.Equal(t, "HASH_GROUP_BY", frame.Fields[3].At(0))
+		require.Nil(t, frame.Fields[1].At(0))
+		require.Equal(t, int64(0), *frame.Fields[1].At(1).(*int64))
+		require.Equal(t, "SEQ_SCAN", frame.Fields[3].At(frame.Rows()-1))
+		require.Equal(t, int64(1000), *frame.Fields[4].At(frame.Rows() - 1).(*int64))
+		require.Contains(t, frame.Meta.ExecutedQueryString, "EXPLAIN (FORMAT JSON) SELECT")
+		require.Len(t, frame.Meta.Notices, 1)
+		require.Contains(t, frame.Meta.Notices[0].Text, "HASH_GROUP_BY (estimated=")
+	})
+
+	t.Run("Should return actual cardinality and timing when analyzing", func(t *testing.T) {
+		res := query(t, "ANALYZE")
+		require.NoError(t, res.Error)
+		frame := res.Frames[0]
+		require.Equal(t, []string{"id", "parent_id", "depth", "operator", "estimated_cardinality", "actual_cardinality", "rows_scanned", "timing_ms", "extra_info"}, fieldNames(frame))
+		require.Equal(t, "HASH_GROUP_BY", frame.Fields[3].At(0))
+		require.Equal(t, int64(10), *frame.Fields[5].At(0).(*int64))
+		require.NotNil(t, frame.Fields[7].At(0))
+		require.Contains(t, frame.Meta.Notices[0].Text, "actual=10")
+	})
+
+	t.Run("Should reject unknown modes", func(t *testing.T) {
+		res := query(t, "verbose")
+		require.ErrorContains(t, res.Error, "unknown explain mode")
+	})
+}
@@ -0,0 +1,116 @@
+package sqleng
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// extensionNameRegex matches the names DuckDB uses for its extensions. Anything else is rejected so that
+// configured names can be inlined into LOAD statements.
+var extensionNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+type extensionInfo struct {
+	Name        string `json:"name"`
+	Loaded      bool   `json:"loaded"`
+	Installed   bool   `json:"installed"`
+	InstallPath string `json:"installPath"`
+	Version     string `json:"version"`
+	Required    bool   `json:"required"`
+}
+
+func validateExtensionNames(names []string) error {
+	for _, name := range names {
+		if !extensionNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid extension name %q", name)
+		}
+	}
+	return nil
+}
+
+// quoteLiteral quotes a string as a DuckDB string literal
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// loadExtensions points DuckDB at the configured extension directory and loads the configured extensions on a new
+// connection. A failing LOAD is only logged: the remaining panels keep working and the health check reports
+// the missing extension.
+func (e *DataSourceHandler) loadExtensions(execer driver.ExecerContext) error {
+	if e.dsInfo.JsonData.ExtensionDirectory != "" {
+		query := "SET extension_directory = " + quoteLiteral(e.dsInfo.JsonData.ExtensionDirectory)
+		if _, err := execer.ExecContext(context.Background(), query, nil); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range e.dsInfo.JsonData.Extensions {
+		if _, err := execer.ExecContext(context.Background(), "LOAD "+name, nil); err != nil {
+			backend.Logger.Warn("error loading extension", "extension", name, "error", err)
+		}
+	}
+	return nil
+}
+
+// listExtensions returns every extension known to DuckDB, flagging the ones required by the datasource settings.
+func (e *DataSourceHandler) listExtensions(ctx context.Context) ([]extensionInfo, error) {
+	db, _, err := e.snapshotDatabase("")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT extension_name, loaded, installed, coalesce(install_path, ''), coalesce(extension_version, '')
+FROM duckdb_extensions() ORDER BY extension_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			e.log.Warn("Failed to close rows", "err", err)
+		}
+	}()
+
+	required := make(map[string]bool, len(e.dsInfo.JsonData.Extensions))
+	for _, name := range e.dsInfo.JsonData.Extensions {
+		required[strings.ToLower(name)] = true
+	}
+
+	extensions := []extensionInfo{}
+	for rows.Next() {
+		var ext extensionInfo
+		if err := rows.Scan(&ext.Name, &ext.Loaded, &ext.Installed, &ext.InstallPath, &ext.Version); err != nil {
+			return nil, err
+		}
+		ext.Required = required[ext.Name]
+		extensions = append(extensions, ext)
+	}
+	return extensions, rows.Err()
+}
+
+// missingExtensions returns the required extensions that are not loaded on the connection pool.
+func (e *DataSourceHandler) missingExtensions(ctx context.Context) ([]string, error) {
+	if len(e.dsInfo.JsonData.Extensions) == 0 {
+		return nil, nil
+	}
+
+	extensions, err := e.listExtensions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := make(map[string]bool, len(extensions))
+	for _, ext := range extensions {
+		loaded[ext.Name] = ext.Loaded
+	}
+
+	var missing []string
+	for _, name := range e.dsInfo.JsonData.Extensions {
+		if !loaded[strings.ToLower(name)] {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
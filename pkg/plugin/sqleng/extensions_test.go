@@ -0,0 +1,110 @@
+package sqleng
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestHandler creates a duckdb file seeded with the given statements and returns a handler reading it
+func newTestHandler(t *testing.T, jsonData JsonData, statements ...string) *DataSourceHandler {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.duckdb")
+	db, err := sql.Open("duckdb", path)
+	require.NoError(t, err)
+	for _, stmt := range statements {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+
+	jsonData.Database = path
+	handler, err := NewQueryDataHandler("", DataPluginConfiguration{
+		DSInfo:            DataSourceInfo{JsonData: jsonData, Database: path},
+		MetricColumnTypes: []string{"UNKNOWN", "TEXT", "VARCHAR", "CHAR", "ENUM"},
+		RowLimit:          1000000,
+	}, &testQueryResultTransformer{}, &testMacroEngine{}, backend.NewLoggerWith("logger", "test"))
+	require.NoError(t, err)
+	t.Cleanup(handler.Dispose)
+	return handler
+}
+
+// queryData runs a single query through QueryData and returns its response. The RefID defaults to A.
+func queryData(t *testing.T, handler *DataSourceHandler, query backend.DataQuery, headers ...map[string]string) backend.DataResponse {
+	t.Helper()
+	if query.RefID == "" {
+		query.RefID = "A"
+	}
+	req := &backend.QueryDataRequest{Queries: []backend.DataQuery{query}}
+	if len(headers) > 0 {
+		req.Headers = headers[0]
+	}
+	resp, err := handler.QueryData(context.Background(), req)
+	require.NoError(t, err)
+	return resp.Responses[query.RefID]
+}
+
+func TestExtensions(t *testing.T) {
+	t.Run("Should reject invalid extension names", func(t *testing.T) {
+		require.NoError(t, validateExtensionNames([]string{"icu", "spatial", "postgres_scanner"}))
+		require.Error(t, validateExtensionNames([]string{"json; DROP TABLE x"}))
+	})
+
+	t.Run("Should report healthy when required extensions are loaded", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{Extensions: []string{"parquet"}})
+		res, err := handler.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusOk, res.Status)
+	})
+
+	t.Run("Should fail the health check when a required extension is missing", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{ExtensionDirectory: t.TempDir(), Extensions: []string{"parquet", "spatial"}})
+		res, err := handler.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusError, res.Status)
+		require.Contains(t, res.Message, "spatial")
+		require.NotContains(t, res.Message, "parquet")
+	})
+
+	t.Run("Should list extensions through the resource endpoint", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{Extensions: []string{"parquet"}})
+		sender := &testResourceSender{}
+		err := handler.CallResource(context.Background(), &backend.CallResourceRequest{Path: "extensions", Method: "GET", URL: "/extensions"}, sender)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, sender.response.Status)
+
+		var extensions []extensionInfo
+		require.NoError(t, json.Unmarshal(sender.response.Body, &extensions))
+		found := false
+		for _, ext := range extensions {
+			if ext.Name == "parquet" {
+				found = true
+				require.True(t, ext.Loaded)
+				require.True(t, ext.Required)
+			}
+		}
+		require.True(t, found)
+	})
+}
+
+// testMacroEngine leaves queries untouched
+type testMacroEngine struct{}
+
+func (m *testMacroEngine) Interpolate(_ *backend.DataQuery, _ backend.TimeRange, sql string) (string, error) {
+	return sql, nil
+}
+
+type testResourceSender struct {
+	response *backend.CallResourceResponse
+}
+
+func (s *testResourceSender) Send(res *backend.CallResourceResponse) error {
+	s.response = res
+	return nil
+}
@@ -0,0 +1,120 @@
+package sqleng
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Fill modes beyond the ones of data.FillMissing. They resample with null points first and fill those afterwards,
+// see fillNullPoints.
+const (
+	fillModeLinear        = "linear"
+	fillModeZeroAfterLast = "zero-after-last"
+)
+
+// setupFill configures the filling of missing points from the fill settings of the query. Without a fill interval
+// the interval of the query is used.
+func (qm *dataQueryModel) setupFill(queryJson QueryJson, queryInterval time.Duration) error {
+	if !queryJson.Fill {
+		return nil
+	}
+
+	qm.FillMissing = &data.FillMissing{}
+	qm.Interval = time.Duration(queryJson.FillInterval * float64(time.Second))
+	if qm.Interval <= 0 {
+		qm.Interval = queryInterval
+	}
+
+	switch mode := strings.ToLower(queryJson.FillMode); mode {
+	case "", "previous":
+		qm.FillMissing.Mode = data.FillModePrevious
+	case "null":
+		qm.FillMissing.Mode = data.FillModeNull
+	case "value":
+		qm.FillMissing.Mode = data.FillModeValue
+		qm.FillMissing.Value = queryJson.FillValue
+	case fillModeLinear, fillModeZeroAfterLast:
+		qm.FillMissing.Mode = data.FillModeNull
+		qm.fillMode = mode
+	default:
+		return fmt.Errorf("unsupported fill mode %q", queryJson.FillMode)
+	}
+	return nil
+}
+
+// alignedStart aligns the start of the time range to the fill interval, counted from the unix epoch
+func alignedStart(from time.Time, interval time.Duration) time.Time {
+	return time.Unix(0, from.UnixNano()/int64(interval)*int64(interval))
+}
+
+// fillNullPoints fills the null points of the numeric fields of a wide time series. Linear interpolates between the
+// surrounding points and leaves the edges null. Zero-after-last sets the points after the first value of a series
+// to zero, the points before it stay null.
+func fillNullPoints(frame *data.Frame, mode string) error {
+	timeIndices := frame.TypeIndices(data.FieldTypeTime, data.FieldTypeNullableTime)
+	if len(timeIndices) == 0 {
+		return fmt.Errorf("can not fill missing, not timeseries frame")
+	}
+	timeField := frame.Fields[timeIndices[0]]
+
+	for _, field := range frame.Fields {
+		if field.Type() != data.FieldTypeNullableFloat64 {
+			continue
+		}
+
+		switch mode {
+		case fillModeZeroAfterLast:
+			started := false
+			for i := 0; i < field.Len(); i++ {
+				if field.At(i).(*float64) != nil {
+					started = true
+				} else if started {
+					zero := 0.0
+					field.Set(i, &zero)
+				}
+			}
+		case fillModeLinear:
+			previous := -1
+			for i := 0; i < field.Len(); i++ {
+				if field.At(i).(*float64) == nil {
+					continue
+				}
+				if previous != -1 && i-previous > 1 {
+					interpolate(timeField, field, previous, i)
+				}
+				previous = i
+			}
+		}
+	}
+	return nil
+}
+
+// interpolate fills the points between the rows from and to, by time
+func interpolate(timeField *data.Field, field *data.Field, from int, to int) {
+	fromTime, ok := timeField.ConcreteAt(from)
+	if !ok {
+		return
+	}
+	toTime, ok := timeField.ConcreteAt(to)
+	if !ok {
+		return
+	}
+	fromValue, toValue := *field.At(from).(*float64), *field.At(to).(*float64)
+	span := toTime.(time.Time).Sub(fromTime.(time.Time))
+	if span <= 0 {
+		return
+	}
+
+	for i := from + 1; i < to; i++ {
+		t, ok := timeField.ConcreteAt(i)
+		if !ok {
+			continue
+		}
+		ratio := float64(t.(time.Time).Sub(fromTime.(time.Time))) / float64(span)
+		value := fromValue + (toValue-fromValue)*ratio
+		field.Set(i, &value)
+	}
+}
@@ -0,0 +1,70 @@
+package sqleng
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFill(t *testing.T) {
+	floats := func(field *data.Field) []*float64 {
+		values := make([]*float64, field.Len())
+		for i := range values {
+			values[i] = field.At(i).(*float64)
+		}
+		return values
+	}
+	newFrame := func() *data.Frame {
+		start := time.Unix(0, 0)
+		return data.NewFrame("",
+			data.NewField("time", nil, []time.Time{start, start.Add(time.Minute), start.Add(2 * time.Minute), start.Add(4 * time.Minute), start.Add(5 * time.Minute)}),
+			data.NewField("value", nil, []*float64{nil, Pointer(1.0), nil, Pointer(4.0), nil}),
+		)
+	}
+
+	t.Run("Should interpolate linearly by time and leave the edges null", func(t *testing.T) {
+		frame := newFrame()
+		require.NoError(t, fillNullPoints(frame, fillModeLinear))
+		require.Equal(t, []*float64{nil, Pointer(1.0), Pointer(2.0), Pointer(4.0), nil}, floats(frame.Fields[1]))
+	})
+
+	t.Run("Should fill zeros once the series started", func(t *testing.T) {
+		frame := newFrame()
+		require.NoError(t, fillNullPoints(frame, fillModeZeroAfterLast))
+		require.Equal(t, []*float64{nil, Pointer(1.0), Pointer(0.0), Pointer(4.0), Pointer(0.0)}, floats(frame.Fields[1]))
+	})
+
+	t.Run("Should derive the fill interval from the query", func(t *testing.T) {
+		qm := &dataQueryModel{}
+		require.NoError(t, qm.setupFill(QueryJson{Fill: true, FillMode: "value", FillValue: 3}, time.Minute))
+		require.Equal(t, time.Minute, qm.Interval)
+		require.Equal(t, data.FillModeValue, qm.FillMissing.Mode)
+
+		require.NoError(t, qm.setupFill(QueryJson{Fill: true, FillInterval: 30, FillMode: "linear"}, time.Minute))
+		require.Equal(t, 30*time.Second, qm.Interval)
+		require.Equal(t, fillModeLinear, qm.fillMode)
+
+		require.Error(t, qm.setupFill(QueryJson{Fill: true, FillMode: "cubic"}, time.Minute))
+	})
+
+	handler := newTestHandler(t, JsonData{},
+		"CREATE TABLE metrics (time TIMESTAMP, value DOUBLE)",
+		"INSERT INTO metrics VALUES ('2024-01-01 00:00:00', 1), ('2024-01-01 00:03:00', 4)",
+	)
+
+	t.Run("Should fill queries without $__timeGroup from the query settings", func(t *testing.T) {
+		from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		res := queryData(t, handler, backend.DataQuery{
+			RefID:     "A",
+			Interval:  time.Minute,
+			TimeRange: backend.TimeRange{From: from, To: from.Add(3 * time.Minute)},
+			JSON:      []byte(`{"rawSql": "SELECT time, value FROM metrics ORDER BY time", "format": "time_series", "fill": true, "fillMode": "linear"}`),
+		})
+		require.NoError(t, res.Error)
+		require.Equal(t, 4, res.Frames[0].Rows())
+		require.Equal(t, []*float64{Pointer(1.0), Pointer(2.0), Pointer(3.0), Pointer(4.0)}, floats(res.Frames[0].Fields[1]))
+	})
+}
@@ -0,0 +1,187 @@
+package sqleng
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	geometryFormatGeoJSON = "geojson"
+	geometryFormatWKT     = "wkt"
+)
+
+// geometryColumnTypes are the spatial extension types that get converted for the Geomap panel
+var geometryColumnTypes = map[string]bool{
+	"GEOMETRY":      true,
+	"WKB_BLOB":      true,
+	"POINT_2D":      true,
+	"LINESTRING_2D": true,
+	"POLYGON_2D":    true,
+}
+
+// spatialLoaded reports whether the spatial extension is loaded into the database, through the Extensions setting
+// or by the PreSql. Geometry detection needs an extra DESCRIBE per query, so it is skipped for databases that
+// cannot return geometries.
+func spatialLoaded(ctx context.Context, db *sql.DB) (bool, error) {
+	var loaded bool
+	err := db.QueryRowContext(ctx, "SELECT count(*) > 0 FROM duckdb_extensions() WHERE extension_name = 'spatial' AND loaded").Scan(&loaded)
+	return loaded, err
+}
+
+// generationSpatialLoaded is spatialLoaded, looked up once per database generation. The extensions are loaded
+// when a connection is opened and do not change afterwards.
+func (e *DataSourceHandler) generationSpatialLoaded(ctx context.Context, db *sql.DB) bool {
+	if loaded, ok := e.spatialGenerations.Load(db); ok {
+		return loaded.(bool)
+	}
+	loaded, err := spatialLoaded(ctx, db)
+	if err != nil {
+		return false
+	}
+	e.spatialGenerations.Store(db, loaded)
+	return loaded
+}
+
+// filterGeometryColumns returns the spatial columns of a described query. The go-duckdb driver reports every
+// geometry as a plain BLOB, so the type aliases are only visible through DESCRIBE.
+func filterGeometryColumns(described []describedColumn) []describedColumn {
+	var columns []describedColumn
+	for _, column := range described {
+		if geometryColumnTypes[strings.ToUpper(column.columnType)] {
+			columns = append(columns, describedColumn{name: column.name, columnType: strings.ToUpper(column.columnType)})
+		}
+	}
+	return columns
+}
+
+// wrapGeometryQuery rewrites the query so that every geometry column is returned as GeoJSON or WKT by the spatial
+// extension. Every geometry column is followed by a latitude and a longitude column at the end of the result,
+// which are NULL for geometries other than points and NaN for empty points.
+func wrapGeometryQuery(query string, columns []describedColumn, format string) string {
+	if len(columns) == 0 {
+		return query
+	}
+	convert := "ST_AsGeoJSON"
+	if format == geometryFormatWKT {
+		convert = "ST_AsText"
+	}
+
+	var replacements, coordinates []string
+	for _, column := range columns {
+		geometry := quoteIdentifier(column.name) + "::GEOMETRY"
+		replacements = append(replacements, fmt.Sprintf("%s(%s)::VARCHAR AS %s", convert, geometry, quoteIdentifier(column.name)))
+		for _, coordinate := range []struct{ function, name string }{{"ST_Y", "latitude"}, {"ST_X", "longitude"}} {
+			coordinates = append(coordinates, fmt.Sprintf("CASE WHEN ST_GeometryType(%s) = 'POINT' THEN coalesce(%s(%s), 'NaN'::DOUBLE) END AS %s",
+				geometry, coordinate.function, geometry, quoteIdentifier(column.name+"_"+coordinate.name)))
+		}
+	}
+	return fmt.Sprintf("SELECT * REPLACE (%s), %s FROM (%s) AS geometry_query",
+		strings.Join(replacements, ", "), strings.Join(coordinates, ", "), strings.TrimRight(strings.TrimSpace(query), ";"))
+}
+
+// quoteIdentifier quotes a string as a DuckDB identifier
+func quoteIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// convertGeometryFields keeps the latitude/longitude fields added by wrapGeometryQuery for the columns holding
+// only points, which the Geomap panel picks up automatically, and drops the others. Empty points have no
+// coordinates. The columns of the query model follow the fields.
+func convertGeometryFields(frame *data.Frame, qm *dataQueryModel, columns []describedColumn) error {
+	// the coordinates follow the columns of the query
+	first := len(frame.Fields) - 2*len(columns)
+	if first < 0 {
+		return fmt.Errorf("the coordinates of the geometry columns are missing")
+	}
+	coordinateFields := frame.Fields[first:]
+	frame.Fields = frame.Fields[:first]
+
+	var kept []*data.Field
+	// keptIndices are the indices of the kept coordinates among the columns of the query
+	var keptIndices []int
+	for i, column := range columns {
+		latitude, longitude := coordinateFields[2*i], coordinateFields[2*i+1]
+		geometry, _ := frame.FieldByName(column.name)
+		if geometry == nil || !onlyPoints(geometry, latitude) {
+			continue
+		}
+		for _, field := range []*data.Field{latitude, longitude} {
+			for j := 0; j < field.Len(); j++ {
+				if v, ok := field.ConcreteAt(j); ok && math.IsNaN(v.(float64)) {
+					field.Set(j, nil)
+				}
+			}
+		}
+		latitude.Name = column.name + "_latitude"
+		longitude.Name = column.name + "_longitude"
+		kept = append(kept, latitude, longitude)
+		keptIndices = append(keptIndices, first+2*i, first+2*i+1)
+	}
+
+	// a single point column gets the plain names so that the Geomap "auto" location mode finds it
+	if len(kept) == 2 {
+		kept[0].Name = "latitude"
+		kept[1].Name = "longitude"
+	}
+	frame.Fields = append(frame.Fields, kept...)
+	dropCoordinateColumns(qm, frame, first, keptIndices)
+	return nil
+}
+
+// dropCoordinateColumns removes the dropped coordinates from the columns of the query model, so that its indices
+// match the fields of the frame again
+func dropCoordinateColumns(qm *dataQueryModel, frame *data.Frame, first int, keptIndices []int) {
+	if qm == nil || len(qm.columnNames) < first {
+		return
+	}
+	names := append([]string{}, qm.columnNames[:first]...)
+	var types []*sql.ColumnType
+	if len(qm.columnTypes) == len(qm.columnNames) {
+		types = append(types, qm.columnTypes[:first]...)
+	}
+	positions := make(map[int]int, len(keptIndices))
+	for _, index := range keptIndices {
+		positions[index] = len(names)
+		names = append(names, frame.Fields[len(names)].Name)
+		if types != nil {
+			types = append(types, qm.columnTypes[index])
+		}
+	}
+	shift := func(i int) int {
+		if i < first {
+			return i
+		}
+		if position, ok := positions[i]; ok {
+			return position
+		}
+		return -1
+	}
+	qm.columnNames = names
+	if types != nil {
+		qm.columnTypes = types
+	}
+	qm.timeIndex = shift(qm.timeIndex)
+	qm.timeEndIndex = shift(qm.timeEndIndex)
+	qm.metricIndex = shift(qm.metricIndex)
+}
+
+// onlyPoints reports whether a geometry field holds at least one geometry and no geometries other than points,
+// whose latitude is never NULL
+func onlyPoints(geometry *data.Field, latitude *data.Field) bool {
+	points := 0
+	for i := 0; i < geometry.Len(); i++ {
+		if _, ok := geometry.ConcreteAt(i); !ok {
+			continue
+		}
+		if _, ok := latitude.ConcreteAt(i); !ok {
+			return false
+		}
+		points++
+	}
+	return points > 0
+}
@@ -0,0 +1,96 @@
+package sqleng
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeometry(t *testing.T) {
+	t.Run("Should convert geometry columns with the spatial functions", func(t *testing.T) {
+		columns := []describedColumn{{name: "location", columnType: "GEOMETRY"}, {name: "raw", columnType: "WKB_BLOB"}}
+		require.Equal(t,
+			`SELECT * REPLACE (ST_AsText("location"::GEOMETRY)::VARCHAR AS "location", ST_AsText("raw"::GEOMETRY)::VARCHAR AS "raw"), `+
+				`CASE WHEN ST_GeometryType("location"::GEOMETRY) = 'POINT' THEN coalesce(ST_Y("location"::GEOMETRY), 'NaN'::DOUBLE) END AS "location_latitude", `+
+				`CASE WHEN ST_GeometryType("location"::GEOMETRY) = 'POINT' THEN coalesce(ST_X("location"::GEOMETRY), 'NaN'::DOUBLE) END AS "location_longitude", `+
+				`CASE WHEN ST_GeometryType("raw"::GEOMETRY) = 'POINT' THEN coalesce(ST_Y("raw"::GEOMETRY), 'NaN'::DOUBLE) END AS "raw_latitude", `+
+				`CASE WHEN ST_GeometryType("raw"::GEOMETRY) = 'POINT' THEN coalesce(ST_X("raw"::GEOMETRY), 'NaN'::DOUBLE) END AS "raw_longitude" `+
+				`FROM (SELECT * FROM stores) AS geometry_query`,
+			wrapGeometryQuery("SELECT * FROM stores;", columns, geometryFormatWKT))
+		require.Contains(t, wrapGeometryQuery("SELECT * FROM stores", columns, geometryFormatGeoJSON), `ST_AsGeoJSON("location"::GEOMETRY)::VARCHAR AS "location"`)
+		require.Equal(t, "SELECT 1", wrapGeometryQuery("SELECT 1", nil, geometryFormatGeoJSON))
+	})
+
+	t.Run("Should keep latitude and longitude fields for a point column", func(t *testing.T) {
+		frame := data.NewFrame("",
+			data.NewField("name", nil, []*string{Pointer("berlin"), Pointer("unknown"), Pointer("nowhere")}),
+			data.NewField("location", nil, []*string{Pointer("POINT (13.4 52.5)"), nil, Pointer("POINT EMPTY")}),
+			data.NewField("location_latitude", nil, []*float64{Pointer(52.5), nil, Pointer(math.NaN())}),
+			data.NewField("location_longitude", nil, []*float64{Pointer(13.4), nil, Pointer(math.NaN())}),
+		)
+		qm := &dataQueryModel{columnNames: []string{"name", "location", "location_latitude", "location_longitude"}, timeIndex: -1, timeEndIndex: -1, metricIndex: 0}
+		require.NoError(t, convertGeometryFields(frame, qm, []describedColumn{{name: "location", columnType: "GEOMETRY"}}))
+		require.Equal(t, []string{"name", "location", "latitude", "longitude"}, qm.columnNames)
+		require.Len(t, frame.Fields, 4)
+		require.Equal(t, "latitude", frame.Fields[2].Name)
+		require.Equal(t, 52.5, *frame.Fields[2].At(0).(*float64))
+		require.Nil(t, frame.Fields[2].At(2))
+		require.Equal(t, "longitude", frame.Fields[3].Name)
+		require.Equal(t, 13.4, *frame.Fields[3].At(0).(*float64))
+		require.Nil(t, frame.Fields[3].At(2))
+	})
+
+	t.Run("Should drop the coordinates of non-point and all-NULL geometry columns", func(t *testing.T) {
+		frame := data.NewFrame("",
+			data.NewField("time", nil, []time.Time{time.Unix(0, 0), time.Unix(60, 0)}),
+			data.NewField("route", nil, []*string{Pointer("LINESTRING (0 0, 1 1)"), Pointer("POINT (1 2)")}),
+			data.NewField("missing", nil, []*string{nil, nil}),
+			data.NewField("route_latitude", nil, []*float64{nil, Pointer(2.0)}),
+			data.NewField("route_longitude", nil, []*float64{nil, Pointer(1.0)}),
+			data.NewField("missing_latitude", nil, []*float64{nil, nil}),
+			data.NewField("missing_longitude", nil, []*float64{nil, nil}),
+		)
+		qm := &dataQueryModel{
+			columnNames: []string{"time", "route", "missing", "route_latitude", "route_longitude", "missing_latitude", "missing_longitude"},
+			timeIndex:   0, timeEndIndex: -1, metricIndex: -1,
+		}
+		err := convertGeometryFields(frame, qm, []describedColumn{{name: "route", columnType: "WKB_BLOB"}, {name: "missing", columnType: "GEOMETRY"}})
+		require.NoError(t, err)
+		require.Len(t, frame.Fields, 3)
+		// the time series conversion walks the columns of the query model over the fields
+		require.Equal(t, []string{"time", "route", "missing"}, qm.columnNames)
+		require.Equal(t, 0, qm.timeIndex)
+	})
+
+	t.Run("Should name the coordinates after their column for several point columns", func(t *testing.T) {
+		frame := data.NewFrame("",
+			data.NewField("origin", nil, []*string{Pointer("POINT (1 2)")}),
+			data.NewField("destination", nil, []*string{Pointer("POINT (3 4)")}),
+			data.NewField("origin_latitude", nil, []*float64{Pointer(2.0)}),
+			data.NewField("origin_longitude", nil, []*float64{Pointer(1.0)}),
+			data.NewField("destination_latitude", nil, []*float64{Pointer(4.0)}),
+			data.NewField("destination_longitude", nil, []*float64{Pointer(3.0)}),
+		)
+		err := convertGeometryFields(frame, nil, []describedColumn{{name: "origin", columnType: "POINT_2D"}, {name: "destination", columnType: "POINT_2D"}})
+		require.NoError(t, err)
+		require.Len(t, frame.Fields, 6)
+		require.Equal(t, "destination_latitude", frame.Fields[4].Name)
+	})
+
+	t.Run("Should only describe queries when spatial is loaded", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{})
+		loaded, err := spatialLoaded(context.Background(), handler.db)
+		require.NoError(t, err)
+		require.False(t, loaded)
+
+		// the answer is kept for the generation
+		require.False(t, handler.generationSpatialLoaded(context.Background(), handler.db))
+		cached, ok := handler.spatialGenerations.Load(handler.db)
+		require.True(t, ok)
+		require.Equal(t, false, cached)
+	})
+}
@@ -0,0 +1,188 @@
+package sqleng
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// The heatmap frame types of Grafana, the SDK does not define them yet
+const (
+	frameTypeHeatmapRows  data.FrameType = "heatmap-rows"
+	frameTypeHeatmapCells data.FrameType = "heatmap-cells"
+)
+
+// heatmapBucketLabel is the label and column holding the upper bound of a bucket, as in Prometheus histograms
+const heatmapBucketLabel = "le"
+
+// histogramQuery unnests the MAP column returned by the histogram aggregate, e.g. from $__histogram, into one row
+// per bucket with the upper bound in an le column. The counts are not cumulative. Queries without a MAP column are
+// returned as they are.
+func histogramQuery(query string, columns []describedColumn) (string, bool) {
+	var histogram string
+	for _, column := range columns {
+		if strings.HasPrefix(column.columnType, "MAP(") {
+			if histogram != "" {
+				// more than one histogram cannot be shown in one heatmap
+				return query, false
+			}
+			histogram = quoteIdentifier(column.name)
+		}
+	}
+	if histogram == "" {
+		return query, false
+	}
+
+	return fmt.Sprintf("SELECT * EXCLUDE (%s), unnest(map_keys(%s)) AS %s, CAST(unnest(map_values(%s)) AS DOUBLE) AS %s FROM (%s) AS heatmap_source",
+		histogram, histogram, heatmapBucketLabel, histogram, histogram, strings.TrimRight(strings.TrimSpace(query), ";")), true
+}
+
+// toHeatmapFrame converts the result of a heatmap query. Results with yMin, yMax or y columns are heatmap cells.
+// Results with an le column are pivoted into heatmap rows with one field per bucket, cumulative counts are
+// turned into counts per bucket. Other results must hold one numeric field per bucket already. The returned flag
+// tells whether the buckets were read from an le column.
+func toHeatmapFrame(frame *data.Frame, qm *dataQueryModel, cumulative bool) (*data.Frame, bool, error) {
+	if qm.timeIndex == -1 {
+		return nil, false, fmt.Errorf("heatmaps need a time column")
+	}
+
+	for _, field := range frame.Fields {
+		switch field.Name {
+		case "yMin", "yMax", "y":
+			if name := frame.Fields[qm.timeIndex].Name; name != "xMin" && name != "xMax" {
+				// the time of a time group is the start of the bucket
+				frame.Fields[qm.timeIndex].Name = "xMin"
+			}
+			setFrameType(frame, frameTypeHeatmapCells)
+			return frame, false, nil
+		}
+	}
+
+	for i, field := range frame.Fields {
+		if field.Name == heatmapBucketLabel {
+			heatmap, err := pivotHeatmapBuckets(frame, qm.timeIndex, i, cumulative)
+			return heatmap, true, err
+		}
+	}
+
+	frame.Fields[qm.timeIndex].Name = data.TimeSeriesTimeFieldName
+	for i := range frame.Fields {
+		if i == qm.timeIndex {
+			continue
+		}
+		var err error
+		if frame, err = convertSQLValueColumnToFloat(frame, i); err != nil {
+			return nil, false, fmt.Errorf("heatmap bucket %q is not numeric: %w", frame.Fields[i].Name, err)
+		}
+	}
+	setFrameType(frame, frameTypeHeatmapRows)
+	return frame, false, nil
+}
+
+// pivotHeatmapBuckets turns rows of time, le and count into one row per time and one field per bucket, sorted by
+// the upper bound of the bucket
+func pivotHeatmapBuckets(frame *data.Frame, timeIndex int, leIndex int, cumulative bool) (*data.Frame, error) {
+	valueIndex := -1
+	for i := range frame.Fields {
+		if i == timeIndex || i == leIndex {
+			continue
+		}
+		if valueIndex != -1 {
+			return nil, fmt.Errorf("heatmap results with an le column must only have a time, an le and a count column")
+		}
+		valueIndex = i
+	}
+	if valueIndex == -1 {
+		return nil, fmt.Errorf("heatmap results with an le column need a count column")
+	}
+
+	counts := map[time.Time]map[float64]float64{}
+	var times []time.Time
+	var bounds []float64
+	for row := 0; row < frame.Rows(); row++ {
+		t, ok := frame.Fields[timeIndex].ConcreteAt(row)
+		if !ok {
+			continue
+		}
+		le, err := bucketBoundAt(frame.Fields[leIndex], row)
+		if err != nil {
+			return nil, err
+		}
+		count, err := frame.Fields[valueIndex].NullableFloatAt(row)
+		if err != nil {
+			return nil, err
+		}
+		if le == nil || count == nil {
+			continue
+		}
+
+		at := t.(time.Time)
+		if counts[at] == nil {
+			counts[at] = map[float64]float64{}
+			times = append(times, at)
+		}
+		if !slices.Contains(bounds, *le) {
+			bounds = append(bounds, *le)
+		}
+		counts[at][*le] += *count
+	}
+	slices.SortFunc(times, func(a, b time.Time) int { return a.Compare(b) })
+	slices.Sort(bounds)
+
+	fields := []*data.Field{data.NewField(data.TimeSeriesTimeFieldName, nil, times)}
+	values := make([][]*float64, len(bounds))
+	for i := range values {
+		values[i] = make([]*float64, len(times))
+	}
+	for row, t := range times {
+		previous := 0.0
+		for i, le := range bounds {
+			count, ok := counts[t][le]
+			if !ok {
+				continue
+			}
+			value := count
+			if cumulative {
+				value, previous = count-previous, count
+			}
+			values[i][row] = &value
+		}
+	}
+	for i, le := range bounds {
+		name := formatBucketBound(le)
+		fields = append(fields, data.NewField(name, data.Labels{heatmapBucketLabel: name}, values[i]))
+	}
+
+	heatmap := data.NewFrame(frame.Name, fields...)
+	heatmap.Meta = frame.Meta
+	setFrameType(heatmap, frameTypeHeatmapRows)
+	return heatmap, nil
+}
+
+// bucketBoundAt reads an le value, a number or a string such as "0.5" or "+Inf"
+func bucketBoundAt(field *data.Field, row int) (*float64, error) {
+	if field.Type() != data.FieldTypeString && field.Type() != data.FieldTypeNullableString {
+		return field.NullableFloatAt(row)
+	}
+	value, ok := field.ConcreteAt(row)
+	if !ok {
+		return nil, nil
+	}
+	le, err := strconv.ParseFloat(strings.TrimSpace(value.(string)), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bucket bound %q", value)
+	}
+	return &le, nil
+}
+
+func formatBucketBound(le float64) string {
+	if math.IsInf(le, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(le, 'g', -1, 64)
+}
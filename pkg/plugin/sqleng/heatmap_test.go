@@ -0,0 +1,76 @@
+package sqleng
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeatmap(t *testing.T) {
+	handler := newTestHandler(t, JsonData{},
+		"CREATE TABLE latencies AS SELECT TIMESTAMP '2024-01-01' + to_minutes(CAST(i % 2 AS BIGINT)) AS time, i AS latency FROM range(0, 10) t(i)",
+		`CREATE TABLE buckets AS SELECT * FROM (VALUES
+			(TIMESTAMP '2024-01-01 00:00:00', '0.5', 2), (TIMESTAMP '2024-01-01 00:00:00', '1', 5), (TIMESTAMP '2024-01-01 00:00:00', '+Inf', 6),
+			(TIMESTAMP '2024-01-01 00:01:00', '0.5', 1), (TIMESTAMP '2024-01-01 00:01:00', '+Inf', 4)) t(time, le, value)`,
+	)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	query := func(t *testing.T, rawSQL string) backend.DataResponse {
+		return queryData(t, handler, backend.DataQuery{JSON: []byte(`{"rawSql": "` + rawSQL + `", "format": "heatmap"}`)})
+	}
+
+	values := func(field *data.Field) []*float64 {
+		result := make([]*float64, field.Len())
+		for i := range result {
+			result[i] = field.At(i).(*float64)
+		}
+		return result
+	}
+	f := func(v float64) *float64 { return &v }
+
+	t.Run("Should turn histograms into heatmap rows", func(t *testing.T) {
+		resp := query(t, "SELECT time, histogram(CAST(latency AS DOUBLE), CAST([2, 5] AS DOUBLE[])) AS latency FROM latencies GROUP BY ALL")
+		require.NoError(t, resp.Error)
+		frame := resp.Frames[0]
+		require.Equal(t, frameTypeHeatmapRows, frame.Meta.Type)
+		require.Equal(t, frameCustomMeta{YMatchWithLabel: "le"}, frame.Meta.Custom)
+		require.Equal(t, []string{"Time", "2", "5", "+Inf"}, []string{frame.Fields[0].Name, frame.Fields[1].Name, frame.Fields[2].Name, frame.Fields[3].Name})
+		require.Equal(t, data.Labels{"le": "+Inf"}, frame.Fields[3].Labels)
+		require.Equal(t, []time.Time{start, start.Add(time.Minute)}, []time.Time{frame.Fields[0].At(0).(time.Time), frame.Fields[0].At(1).(time.Time)})
+		require.Equal(t, []*float64{f(2), f(1)}, values(frame.Fields[1]))
+		require.Equal(t, []*float64{f(1), f(2)}, values(frame.Fields[2]))
+		require.Equal(t, []*float64{f(2), f(2)}, values(frame.Fields[3]))
+	})
+
+	t.Run("Should turn cumulative le buckets into counts per bucket", func(t *testing.T) {
+		resp := query(t, "SELECT time, le, value FROM buckets")
+		require.NoError(t, resp.Error)
+		frame := resp.Frames[0]
+		require.Len(t, frame.Fields, 4)
+		require.Equal(t, "1", frame.Fields[2].Name)
+		require.Equal(t, []*float64{f(2), f(1)}, values(frame.Fields[1]))
+		require.Equal(t, []*float64{f(3), nil}, values(frame.Fields[2]))
+		require.Equal(t, []*float64{f(1), f(3)}, values(frame.Fields[3]))
+	})
+
+	t.Run("Should keep bucket columns and cells", func(t *testing.T) {
+		resp := query(t, `SELECT TIMESTAMP '2024-01-01' AS time, 1 AS \"10\", CAST(2.5 AS DOUBLE) AS \"20\"`)
+		require.NoError(t, resp.Error)
+		require.Equal(t, frameTypeHeatmapRows, resp.Frames[0].Meta.Type)
+		require.Equal(t, []*float64{f(2.5)}, values(resp.Frames[0].Fields[2]))
+		require.Nil(t, resp.Frames[0].Meta.Custom)
+
+		resp = query(t, `SELECT TIMESTAMP '2024-01-01' AS time, 0 AS \"yMin\", 10 AS \"yMax\", 3 AS count`)
+		require.NoError(t, resp.Error)
+		require.Equal(t, frameTypeHeatmapCells, resp.Frames[0].Meta.Type)
+		require.Equal(t, "xMin", resp.Frames[0].Fields[0].Name)
+	})
+
+	t.Run("Should need a time column", func(t *testing.T) {
+		require.ErrorContains(t, query(t, "SELECT le, value FROM buckets").Error, "time column")
+		require.ErrorContains(t, query(t, "SELECT time, le, value, 1 AS other FROM buckets").Error, "count column")
+	})
+}
@@ -0,0 +1,39 @@
+package sqleng
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// legendFormatRegex matches the {{label}} placeholders of a legend format
+var legendFormatRegex = regexp.MustCompile(`\{\{\s*(.+?)\s*\}\}`)
+
+// legendNameKey is replaced by the name of the field instead of a label
+const legendNameKey = "__name__"
+
+// renderLegend fills the placeholders of the legend format. Labels the series does not have render empty.
+func renderLegend(format string, name string, labels data.Labels) string {
+	return legendFormatRegex.ReplaceAllStringFunc(format, func(placeholder string) string {
+		key := legendFormatRegex.FindStringSubmatch(placeholder)[1]
+		if key == legendNameKey {
+			return name
+		}
+		return labels[key]
+	})
+}
+
+// applyLegendFormat sets the display name of every value field of the time series frame, so that panels and
+// alerts name the series the same way
+func applyLegendFormat(frame *data.Frame, format string) {
+	for _, field := range frame.Fields {
+		if t := field.Type(); t == data.FieldTypeTime || t == data.FieldTypeNullableTime {
+			continue
+		}
+		if field.Config == nil {
+			field.Config = &data.FieldConfig{}
+		}
+		field.Config.DisplayNameFromDS = strings.TrimSpace(renderLegend(format, field.Name, field.Labels))
+	}
+}
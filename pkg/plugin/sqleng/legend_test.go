@@ -0,0 +1,46 @@
+package sqleng
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLegendFormat(t *testing.T) {
+	t.Run("Should render labels and the field name", func(t *testing.T) {
+		labels := data.Labels{"service": "api", "region": "eu"}
+		require.Equal(t, "api @ eu", renderLegend("{{service}} @ {{ region }}", "value", labels))
+		require.Equal(t, "value: api ()", renderLegend("{{__name__}}: {{service}} ({{missing}})", "value", labels))
+	})
+
+	handler := newTestHandler(t, JsonData{},
+		"CREATE TYPE tier AS ENUM ('gold', 'silver')",
+		"CREATE TABLE metrics (time TIMESTAMP, metric VARCHAR, region VARCHAR, service VARCHAR, tier tier, value DOUBLE)",
+		`INSERT INTO metrics VALUES
+			('2024-01-01 00:00:00', 'latency', 'eu', 'api', 'gold', 1), ('2024-01-01 00:00:00', 'latency', 'us', 'web', 'silver', 2),
+			('2024-01-01 00:01:00', 'latency', 'eu', 'api', 'gold', 3), ('2024-01-01 00:01:00', 'latency', 'us', 'web', 'silver', 4)`,
+	)
+
+	query := func(t *testing.T, queryJSON string) *data.Frame {
+		resp := queryData(t, handler, backend.DataQuery{JSON: []byte(queryJSON)})
+		require.NoError(t, resp.Error)
+		return resp.Frames[0]
+	}
+
+	t.Run("Should keep every string and enum column as a label", func(t *testing.T) {
+		frame := query(t, `{"rawSql": "SELECT time, metric, region, service, tier, value FROM metrics ORDER BY time", "format": "time_series"}`)
+		require.Len(t, frame.Fields, 3)
+		require.Equal(t, "latency", frame.Fields[1].Name)
+		require.Equal(t, data.Labels{"region": "eu", "service": "api", "tier": "gold"}, frame.Fields[1].Labels)
+	})
+
+	t.Run("Should name the series with the legend format", func(t *testing.T) {
+		frame := query(t, `{"rawSql": "SELECT time, region, service, value FROM metrics ORDER BY time", "format": "time_series", "legendFormat": "{{service}} @ {{region}}"}`)
+		require.Len(t, frame.Fields, 3)
+		require.Nil(t, frame.Fields[0].Config)
+		require.Equal(t, "api @ eu", frame.Fields[1].Config.DisplayNameFromDS)
+		require.Equal(t, "web @ us", frame.Fields[2].Config.DisplayNameFromDS)
+	})
+}
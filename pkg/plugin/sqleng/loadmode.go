@@ -0,0 +1,261 @@
+package sqleng
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// The LoadMode settings: the database file is read in place, or copied into an in-memory database on every load
+const (
+	loadModeFile   = "file"
+	loadModeMemory = "memory"
+)
+
+// loadedFileCatalog is the name the database file is attached under while it is copied into memory
+const loadedFileCatalog = "loaded_file"
+
+var byteSizeRegex = regexp.MustCompile(`^\s*([0-9]+(?:\.[0-9]+)?)\s*([a-zA-Z]*)\s*$`)
+
+// byteUnits are the units of sizes such as "4GB" or "512MiB", as understood by DuckDB's memory_limit
+var byteUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// loadResult describes how the current database generation was loaded, reported by the health check
+type loadResult struct {
+	mode string
+	// size is the memory used by the copied database in memory mode
+	size int64
+	// fallback is why a database configured for memory mode was read from the file instead
+	fallback string
+}
+
+// parseByteSize parses a size such as "4GB". An empty size is 0, which means unlimited.
+func parseByteSize(size string) (int64, error) {
+	if strings.TrimSpace(size) == "" {
+		return 0, nil
+	}
+	match := byteSizeRegex.FindStringSubmatch(size)
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	unit, ok := byteUnits[strings.ToLower(match[2])]
+	if !ok {
+		return 0, fmt.Errorf("invalid unit %q in size %q", match[2], size)
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(math.Round(value * unit)), nil
+}
+
+// formatByteSize formats a size in binary units, e.g. "26.8 MiB"
+func formatByteSize(size int64) string {
+	units := []string{"bytes", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for ; value >= 1024 && i < len(units)-1; i++ {
+		value /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+func validateLoadMode(jsonData JsonData) error {
+	switch jsonData.LoadMode {
+	case "", loadModeFile, loadModeMemory:
+	default:
+		return fmt.Errorf("invalid load mode %q", jsonData.LoadMode)
+	}
+	_, err := parseByteSize(jsonData.MemoryCeiling)
+	return err
+}
+
+// copyIntoMemory copies the database file into the in-memory database of a new generation. The file is detached
+// right away, so that it is not held open while the generation is served. The memory limit is the MemoryCeiling
+// setting during the copy, and nothing is spilled to disk, so that a database larger than it fails to load instead
+// of using the memory of the host.
+func (e *DataSourceHandler) copyIntoMemory(execer driver.ExecerContext, path string) (err error) {
+	ctx := context.Background()
+	ceiling, err := parseByteSize(e.dsInfo.JsonData.MemoryCeiling)
+	if err != nil {
+		return err
+	}
+	if ceiling > 0 {
+		for _, setting := range []string{fmt.Sprintf("SET memory_limit = '%dB'", ceiling), "SET temp_directory = ''"} {
+			if _, err := execer.ExecContext(ctx, setting, nil); err != nil {
+				return err
+			}
+		}
+		defer func() {
+			for _, reset := range []string{"RESET memory_limit", "RESET temp_directory"} {
+				if _, resetErr := execer.ExecContext(ctx, reset, nil); err == nil {
+					err = resetErr
+				}
+			}
+		}()
+	}
+
+	attach := fmt.Sprintf("ATTACH %s AS %s (READ_ONLY)", quoteLiteral(path), loadedFileCatalog)
+	if _, err := execer.ExecContext(ctx, attach, nil); err != nil {
+		return err
+	}
+	_, err = execer.ExecContext(ctx, "COPY FROM DATABASE "+loadedFileCatalog+" TO memory", nil)
+	if _, detachErr := execer.ExecContext(ctx, "DETACH "+loadedFileCatalog, nil); err == nil {
+		err = detachErr
+	}
+	return err
+}
+
+// readStatements are the statements allowed on writable tables shared by every user, see checkReadOnlyQuery.
+// SET, PRAGMA, CALL, LOAD and USE are not: they change the settings, the extensions or the pooled connections
+// for everyone. Table functions are read with SELECT * FROM.
+var readStatements = map[string]bool{
+	"SELECT": true, "WITH": true, "FROM": true, "VALUES": true, "TABLE": true, "DESCRIBE": true, "SHOW": true,
+	"SUMMARIZE": true, "PIVOT": true, "UNPIVOT": true, "EXPLAIN": true,
+}
+
+// withStatements are the statements following the common table expressions of a WITH statement
+var withStatements = map[string]bool{
+	"SELECT": true, "FROM": true, "VALUES": true, "TABLE": true, "PIVOT": true, "UNPIVOT": true,
+	"INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true,
+}
+
+// readOnlyQueries tells whether the queries must pass checkReadOnlyQuery: a copy in memory and the warmup catalog
+// are writable and shared by every user of the datasource. A file alone is opened read-only and DuckDB rejects
+// writes itself.
+func (e *DataSourceHandler) readOnlyQueries() bool {
+	return e.dsInfo.JsonData.LoadMode == loadModeMemory || len(e.dsInfo.JsonData.WarmupQueries) > 0
+}
+
+// checkReadOnlyQuery rejects the statements of a query that may change the data, see readOnlyQueries
+func checkReadOnlyQuery(query string) error {
+	for _, statement := range statementKeywords(query) {
+		if len(statement) == 0 {
+			continue
+		}
+		first := statement[0]
+		if first == "EXPLAIN" && len(statement) > 1 {
+			// EXPLAIN ANALYZE runs the statement
+			rest := statement[1:]
+			if rest[0] == "ANALYZE" || rest[0] == "ANALYSE" {
+				rest = rest[1:]
+			}
+			if len(rest) > 0 {
+				first = rest[0]
+			}
+		}
+		if !readStatements[first] {
+			return fmt.Errorf("%s statements are not allowed, the tables of the datasource are shared by every user", first)
+		}
+		if first == "WITH" {
+			// the bodies of the common table expressions are in parentheses
+			for _, keyword := range statement[1:] {
+				if !withStatements[keyword] {
+					continue
+				}
+				if !readStatements[keyword] {
+					return fmt.Errorf("%s statements are not allowed, the tables of the datasource are shared by every user", keyword)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// statementKeywords splits the query into statements and returns the upper-cased words of every statement outside
+// of parentheses, string literals, quoted identifiers and comments. A leading parenthesis counts as SELECT.
+func statementKeywords(query string) [][]string {
+	statements := [][]string{nil}
+	depth := 0
+	for i := 0; i < len(query); {
+		if next, skipped := skipNonCode(query, i); skipped {
+			i = next
+			continue
+		}
+		c := query[i]
+		current := &statements[len(statements)-1]
+		switch {
+		case c == ';' && depth == 0:
+			statements = append(statements, nil)
+		case c == '(':
+			if depth == 0 && len(*current) == 0 {
+				*current = append(*current, "SELECT")
+			}
+			depth++
+		case c == ')':
+			depth = max(depth-1, 0)
+		case isMacroNameChar(c):
+			start := i
+			for i < len(query) && isMacroNameChar(query[i]) {
+				i++
+			}
+			if depth == 0 {
+				*current = append(*current, strings.ToUpper(query[start:i]))
+			}
+			continue
+		}
+		i++
+	}
+	return statements
+}
+
+// openDatabase opens a new generation of the database according to the LoadMode setting. In memory mode, a file
+// larger than the MemoryCeiling setting, or a copy using more memory than it, falls back to reading the file.
+func (e *DataSourceHandler) openDatabase(path string, fileSize int64) (*sql.DB, *loadResult, error) {
+	if e.dsInfo.JsonData.LoadMode != loadModeMemory {
+		db, err := e.initDatabaseConnection(path, false)
+		return db, &loadResult{mode: loadModeFile}, err
+	}
+
+	ceiling, err := parseByteSize(e.dsInfo.JsonData.MemoryCeiling)
+	if err != nil {
+		return nil, nil, err
+	}
+	fallback := ""
+	if ceiling > 0 && fileSize > ceiling {
+		fallback = fmt.Sprintf("the file of %s exceeds the memory ceiling of %s", formatByteSize(fileSize), formatByteSize(ceiling))
+	} else {
+		db, err := e.initDatabaseConnection(path, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		// the first connection copies the file
+		var size int64
+		if err := db.QueryRow("SELECT CAST(coalesce(sum(memory_usage_bytes), 0) AS BIGINT) FROM duckdb_memory()").Scan(&size); err != nil {
+			fallback = fmt.Sprintf("loading into memory failed: %s", err)
+		} else if ceiling > 0 && size > ceiling {
+			fallback = fmt.Sprintf("the loaded database of %s exceeds the memory ceiling of %s", formatByteSize(size), formatByteSize(ceiling))
+		} else {
+			return db, &loadResult{mode: loadModeMemory, size: size}, nil
+		}
+		if err := db.Close(); err != nil {
+			backend.Logger.Error("error closing database", "error", err)
+		}
+	}
+
+	backend.Logger.Warn("falling back to reading the database file", "reason", fallback)
+	db, err := e.initDatabaseConnection(path, false)
+	return db, &loadResult{mode: loadModeFile, fallback: fallback}, err
+}
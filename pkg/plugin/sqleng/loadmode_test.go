@@ -0,0 +1,130 @@
+package sqleng
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMode(t *testing.T) {
+	t.Run("Should parse sizes", func(t *testing.T) {
+		for size, expected := range map[string]int64{"": 0, "1024": 1024, "4GB": 4e9, "512 MiB": 512 << 20, "1.5kb": 1500} {
+			parsed, err := parseByteSize(size)
+			require.NoError(t, err, size)
+			require.Equal(t, expected, parsed, size)
+		}
+		for _, size := range []string{"big", "4 parsecs", "-1GB"} {
+			_, err := parseByteSize(size)
+			require.Error(t, err, size)
+		}
+		require.Equal(t, "26.8 MiB", formatByteSize(28049408))
+		require.Equal(t, "512 bytes", formatByteSize(512))
+	})
+
+	t.Run("Should reject unknown load modes", func(t *testing.T) {
+		require.NoError(t, validateLoadMode(JsonData{LoadMode: "memory", MemoryCeiling: "1GB"}))
+		require.Error(t, validateLoadMode(JsonData{LoadMode: "mmap"}))
+		require.Error(t, validateLoadMode(JsonData{LoadMode: "memory", MemoryCeiling: "lots"}))
+	})
+
+	t.Run("Should copy the database into memory and let go of the file", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{LoadMode: "memory", PreSql: "CREATE TEMP VIEW recent AS SELECT * FROM facts WHERE value > 5"},
+			"CREATE TABLE facts AS SELECT range AS value FROM range(10)",
+			"CREATE VIEW total AS SELECT sum(value) AS total FROM facts")
+
+		// the file may be replaced while it is served
+		require.NoError(t, os.WriteFile(handler.dsInfo.Database, []byte("truncated"), 0o600))
+
+		var total, recent int64
+		require.NoError(t, handler.db.QueryRow("SELECT total FROM total").Scan(&total))
+		require.Equal(t, int64(45), total)
+		require.NoError(t, handler.db.QueryRow("SELECT count(*) FROM recent").Scan(&recent))
+		require.Equal(t, int64(4), recent)
+
+		var attached int64
+		require.NoError(t, handler.db.QueryRow("SELECT count(*) FROM duckdb_databases() WHERE database_name = 'loaded_file'").Scan(&attached))
+		require.Equal(t, int64(0), attached)
+
+		res, err := handler.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusOk, res.Status)
+		require.Contains(t, res.Message, "into memory")
+	})
+
+	t.Run("Should fall back to the file above the memory ceiling", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{LoadMode: "memory", MemoryCeiling: "1KB"},
+			"CREATE TABLE facts AS SELECT range AS value FROM range(10)")
+
+		var count int64
+		require.NoError(t, handler.db.QueryRow("SELECT count(*) FROM facts").Scan(&count))
+		require.Equal(t, int64(10), count)
+
+		res, err := handler.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusOk, res.Status)
+		require.Contains(t, res.Message, "exceeds the memory ceiling of 1000 bytes")
+	})
+
+	t.Run("Should fall back to the file when the copy exceeds the memory ceiling", func(t *testing.T) {
+		// the constant column compresses to a small file but not in memory
+		handler := newTestHandler(t, JsonData{LoadMode: "memory", MemoryCeiling: "4MB"},
+			"CREATE TABLE facts AS SELECT 42 AS value FROM range(2000000)")
+		info, err := os.Stat(handler.dsInfo.Database)
+		require.NoError(t, err)
+		require.Less(t, info.Size(), int64(4e6))
+
+		var count int64
+		require.NoError(t, handler.db.QueryRow("SELECT count(*) FROM facts").Scan(&count))
+		require.Equal(t, int64(2000000), count)
+
+		res, err := handler.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Contains(t, res.Message, "loading into memory failed")
+	})
+
+	t.Run("Should only run read statements on the in-memory database", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{LoadMode: "memory"}, "CREATE TABLE facts AS SELECT range AS value FROM range(10)")
+		query := func(rawSQL string) backend.DataResponse {
+			return queryData(t, handler, backend.DataQuery{JSON: []byte(`{"rawSql": "` + rawSQL + `", "format": "table"}`)})
+		}
+
+		for _, rawSQL := range []string{
+			"DELETE FROM facts",
+			"DROP TABLE facts",
+			"SELECT 1; DROP TABLE facts",
+			"WITH doomed AS (SELECT 1) DELETE FROM facts",
+			"EXPLAIN ANALYZE DELETE FROM facts",
+			"/* SELECT */ UPDATE facts SET value = 0",
+			"SET GLOBAL threads = 1",
+			"RESET memory_limit",
+			"PRAGMA disable_optimizer",
+			"CALL pragma_version()",
+			"LOAD httpfs",
+			"USE memory",
+		} {
+			require.ErrorContains(t, query(rawSQL).Error, "statements are not allowed", rawSQL)
+		}
+		for _, rawSQL := range []string{
+			"SELECT count(*) AS n FROM facts WHERE 'DELETE' != ''",
+			"WITH deleted AS (SELECT value AS \\\"update\\\" FROM facts) SELECT count(*) AS n FROM deleted",
+			"(SELECT count(*) AS n FROM facts)",
+			"FROM facts SELECT count(*) AS n",
+		} {
+			resp := query(rawSQL)
+			require.NoError(t, resp.Error, rawSQL)
+			require.Equal(t, int64(10), *resp.Frames[0].Fields[0].At(0).(*int64), rawSQL)
+		}
+	})
+
+	t.Run("Should warm up the in-memory database", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{LoadMode: "memory", WarmupQueries: []string{"CREATE TEMP TABLE totals AS SELECT sum(value) AS total FROM facts"}},
+			"CREATE TABLE facts AS SELECT range AS value FROM range(10)")
+
+		var total int64
+		require.NoError(t, handler.db.QueryRow("SELECT total FROM totals").Scan(&total))
+		require.Equal(t, int64(45), total)
+	})
+}
@@ -0,0 +1,201 @@
+package sqleng
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// logBodyColumnNames and logLevelColumnNames are checked in order, case-insensitively
+var (
+	logBodyColumnNames  = []string{"body", "message", "msg", "line", "log"}
+	logLevelColumnNames = []string{"level", "severity", "lvl", "loglevel"}
+)
+
+// normalizeLogLevel maps level names and syslog severities onto the levels known to Grafana.
+func normalizeLogLevel(level string) string {
+	level = strings.ToLower(strings.TrimSpace(level))
+	if n, err := strconv.Atoi(level); err == nil {
+		switch {
+		case n < 0 || n > 7:
+			return "unknown"
+		case n <= 2:
+			return "critical"
+		case n == 3:
+			return "error"
+		case n == 4:
+			return "warning"
+		case n <= 6:
+			return "info"
+		default:
+			return "debug"
+		}
+	}
+
+	switch level {
+	case "emerg", "emergency", "alert", "crit", "critical", "fatal", "panic":
+		return "critical"
+	case "err", "eror", "error":
+		return "error"
+	case "warn", "warning":
+		return "warning"
+	case "info", "information", "informational", "notice":
+		return "info"
+	case "dbug", "debug":
+		return "debug"
+	case "trace":
+		return "trace"
+	default:
+		return "unknown"
+	}
+}
+
+func findFieldByName(frame *data.Frame, names []string, skip map[int]bool) int {
+	for _, name := range names {
+		for i, field := range frame.Fields {
+			if !skip[i] && strings.EqualFold(field.Name, name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isStringField(field *data.Field) bool {
+	t := field.Type()
+	return t == data.FieldTypeString || t == data.FieldTypeNullableString
+}
+
+func stringAt(field *data.Field, i int) (string, bool) {
+	switch v := field.At(i).(type) {
+	case string:
+		return v, true
+	case *string:
+		if v == nil {
+			return "", false
+		}
+		return *v, true
+	default:
+		return "", false
+	}
+}
+
+// convertToLogsFrame turns a result into a log-lines frame: a timestamp, the body, a normalised severity and the
+// remaining string columns as per-row labels. Other columns are kept as they are.
+func convertToLogsFrame(frame *data.Frame, qm *dataQueryModel) (*data.Frame, error) {
+	timeIndex := qm.timeIndex
+	if timeIndex == -1 {
+		for i, field := range frame.Fields {
+			if t := field.Type(); t == data.FieldTypeTime || t == data.FieldTypeNullableTime {
+				timeIndex = i
+				break
+			}
+		}
+	}
+	if timeIndex == -1 {
+		return nil, errors.New("no time column found")
+	}
+
+	used := map[int]bool{timeIndex: true}
+	levelIndex := findFieldByName(frame, logLevelColumnNames, used)
+	if levelIndex != -1 {
+		used[levelIndex] = true
+	}
+	bodyIndex := findFieldByName(frame, logBodyColumnNames, used)
+	if bodyIndex == -1 {
+		for i, field := range frame.Fields {
+			if !used[i] && isStringField(field) {
+				bodyIndex = i
+				break
+			}
+		}
+	}
+	if bodyIndex == -1 {
+		return nil, errors.New("no body column found")
+	}
+	used[bodyIndex] = true
+
+	rows := frame.Rows()
+	timestamp := frame.Fields[timeIndex]
+	timestamp.Name = "timestamp"
+
+	body := data.NewFieldFromFieldType(data.FieldTypeString, rows)
+	body.Name = "body"
+	for i := 0; i < rows; i++ {
+		if s, ok := stringAt(frame.Fields[bodyIndex], i); ok {
+			body.Set(i, s)
+		} else if v, ok := frame.Fields[bodyIndex].ConcreteAt(i); ok {
+			body.Set(i, toString(v))
+		}
+	}
+
+	fields := []*data.Field{timestamp, body}
+
+	if levelIndex != -1 {
+		severity := data.NewFieldFromFieldType(data.FieldTypeString, rows)
+		severity.Name = "severity"
+		for i := 0; i < rows; i++ {
+			level := "unknown"
+			if v, ok := frame.Fields[levelIndex].ConcreteAt(i); ok {
+				level = normalizeLogLevel(toString(v))
+			}
+			severity.Set(i, level)
+		}
+		fields = append(fields, severity)
+	}
+
+	var labelFields, otherFields []*data.Field
+	for i, field := range frame.Fields {
+		if used[i] {
+			continue
+		}
+		if isStringField(field) {
+			labelFields = append(labelFields, field)
+		} else {
+			otherFields = append(otherFields, field)
+		}
+	}
+
+	if len(labelFields) > 0 {
+		labels := data.NewFieldFromFieldType(data.FieldTypeJSON, rows)
+		labels.Name = "labels"
+		for i := 0; i < rows; i++ {
+			rowLabels := make(map[string]string, len(labelFields))
+			for _, field := range labelFields {
+				if s, ok := stringAt(field, i); ok {
+					rowLabels[field.Name] = s
+				}
+			}
+			b, err := json.Marshal(rowLabels)
+			if err != nil {
+				return nil, err
+			}
+			labels.Set(i, json.RawMessage(b))
+		}
+		fields = append(fields, labels)
+	}
+
+	logsFrame := data.NewFrame(frame.Name, append(fields, otherFields...)...)
+	logsFrame.Meta = frame.Meta
+	if logsFrame.Meta == nil {
+		logsFrame.Meta = &data.FrameMeta{}
+	}
+	setFrameType(logsFrame, data.FrameTypeLogLines)
+	logsFrame.Meta.PreferredVisualization = data.VisTypeLogs
+	return logsFrame, nil
+}
+
+func toString(v any) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	default:
+		return fmt.Sprint(v)
+	}
+}
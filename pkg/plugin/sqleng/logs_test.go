@@ -0,0 +1,54 @@
+package sqleng
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogs(t *testing.T) {
+	t.Run("Should normalise log levels", func(t *testing.T) {
+		require.Equal(t, "critical", normalizeLogLevel("FATAL"))
+		require.Equal(t, "error", normalizeLogLevel("err"))
+		require.Equal(t, "warning", normalizeLogLevel(" Warn "))
+		require.Equal(t, "info", normalizeLogLevel("notice"))
+		require.Equal(t, "debug", normalizeLogLevel("7"))
+		require.Equal(t, "error", normalizeLogLevel("3"))
+		require.Equal(t, "unknown", normalizeLogLevel("verbose"))
+	})
+
+	t.Run("Should return a log-lines frame for the logs format", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{},
+			"CREATE TABLE logs (time TIMESTAMP, message VARCHAR, severity VARCHAR, host VARCHAR, status INTEGER)",
+			"INSERT INTO logs VALUES ('2024-01-01 00:00:00', 'started', 'INFO', 'a', 200), ('2024-01-01 00:00:01', 'failed', 'ERR', NULL, 500)",
+		)
+		res := queryData(t, handler, backend.DataQuery{
+			JSON: []byte(`{"rawSql": "SELECT * FROM logs ORDER BY time", "format": "logs"}`),
+		})
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+
+		frame := res.Frames[0]
+		require.Equal(t, data.FrameTypeLogLines, frame.Meta.Type)
+		require.Equal(t, data.VisType(data.VisTypeLogs), frame.Meta.PreferredVisualization)
+		require.Equal(t, []string{"timestamp", "body", "severity", "labels", "status"}, fieldNames(frame))
+		require.Equal(t, time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC), frame.Fields[0].At(1).(*time.Time).UTC())
+		require.Equal(t, "failed", frame.Fields[1].At(1))
+		require.Equal(t, "info", frame.Fields[2].At(0))
+		require.Equal(t, "error", frame.Fields[2].At(1))
+		require.JSONEq(t, `{"host":"a"}`, string(frame.Fields[3].At(0).(json.RawMessage)))
+		require.JSONEq(t, `{}`, string(frame.Fields[3].At(1).(json.RawMessage)))
+	})
+}
+
+func fieldNames(frame *data.Frame) []string {
+	names := make([]string, len(frame.Fields))
+	for i, field := range frame.Fields {
+		names[i] = field.Name
+	}
+	return names
+}
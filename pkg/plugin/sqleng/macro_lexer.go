@@ -0,0 +1,152 @@
+package sqleng
+
+import (
+	"strings"
+)
+
+// MacroCall is a call of a macro such as $__timeGroup(ts, 1h) found in a query
+type MacroCall struct {
+	// Name is the macro name without the $
+	Name string
+	// Args are split at the top-level commas and trimmed. A call without arguments has a single empty argument.
+	Args []string
+	// Start and End are the byte offsets of the call, from the $ up to and including the closing parenthesis
+	Start int
+	End   int
+}
+
+// FindMacroCalls lexes the query and returns the macro calls outside of string literals, quoted identifiers,
+// dollar-quoted strings and comments. Parentheses inside the arguments must be balanced, a call that is never
+// closed is not a call. Commas inside brackets, such as list literals, do not split arguments either.
+func FindMacroCalls(sql string) []MacroCall {
+	var calls []MacroCall
+	for i := 0; i < len(sql); {
+		if next, skipped := skipNonCode(sql, i); skipped {
+			i = next
+			continue
+		}
+		if sql[i] != '$' {
+			i++
+			continue
+		}
+
+		nameEnd := i + 1
+		for nameEnd < len(sql) && isMacroNameChar(sql[nameEnd]) {
+			nameEnd++
+		}
+		if nameEnd == i+1 || nameEnd >= len(sql) || sql[nameEnd] != '(' {
+			i = nameEnd
+			continue
+		}
+
+		args, end, ok := lexMacroArgs(sql, nameEnd+1)
+		if !ok {
+			i = nameEnd
+			continue
+		}
+		calls = append(calls, MacroCall{Name: sql[i+1 : nameEnd], Args: args, Start: i, End: end})
+		i = end
+	}
+	return calls
+}
+
+// ReplaceMacros replaces every macro call with the result of repl. The first error stops the replacement.
+func (m *SQLMacroEngineBase) ReplaceMacros(sql string, repl func(call MacroCall) (string, error)) (string, error) {
+	var result strings.Builder
+	lastIndex := 0
+	for _, call := range FindMacroCalls(sql) {
+		replacement, err := repl(call)
+		if err != nil {
+			return "", err
+		}
+		result.WriteString(sql[lastIndex:call.Start])
+		result.WriteString(replacement)
+		lastIndex = call.End
+	}
+	result.WriteString(sql[lastIndex:])
+	return result.String(), nil
+}
+
+func isMacroNameChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// lexMacroArgs reads the arguments starting after the opening parenthesis. It returns the offset after the
+// closing parenthesis.
+func lexMacroArgs(sql string, start int) ([]string, int, bool) {
+	var args []string
+	depth := 0
+	argStart := start
+	for i := start; i < len(sql); {
+		if next, skipped := skipNonCode(sql, i); skipped {
+			i = next
+			continue
+		}
+		switch sql[i] {
+		case '(', '[', '{':
+			depth++
+		case ')':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(sql[argStart:i]))
+				return args, i + 1, true
+			}
+			depth--
+		case ']', '}':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(sql[argStart:i]))
+				argStart = i + 1
+			}
+		}
+		i++
+	}
+	return nil, 0, false
+}
+
+// skipNonCode skips a string literal, quoted identifier, dollar-quoted string or comment starting at i. An
+// unterminated one runs to the end of the query.
+func skipNonCode(sql string, i int) (int, bool) {
+	switch {
+	case sql[i] == '\'' || sql[i] == '"':
+		quote := sql[i]
+		for j := i + 1; j < len(sql); j++ {
+			if sql[j] == quote {
+				// a doubled quote is an escaped quote
+				if j+1 < len(sql) && sql[j+1] == quote {
+					j++
+					continue
+				}
+				return j + 1, true
+			}
+		}
+		return len(sql), true
+	case strings.HasPrefix(sql[i:], "--"):
+		if end := strings.IndexByte(sql[i:], '\n'); end != -1 {
+			return i + end + 1, true
+		}
+		return len(sql), true
+	case strings.HasPrefix(sql[i:], "/*"):
+		if end := strings.Index(sql[i+2:], "*/"); end != -1 {
+			return i + 2 + end + 2, true
+		}
+		return len(sql), true
+	case sql[i] == '$':
+		// $tag$ ... $tag$, the tag may be empty
+		j := i + 1
+		for j < len(sql) && isMacroNameChar(sql[j]) {
+			j++
+		}
+		if j >= len(sql) || sql[j] != '$' || (j > i+1 && '0' <= sql[i+1] && sql[i+1] <= '9') {
+			return i, false
+		}
+		tag := sql[i : j+1]
+		if end := strings.Index(sql[j+1:], tag); end != -1 {
+			return j + 1 + end + len(tag), true
+		}
+		return len(sql), true
+	}
+	return i, false
+}
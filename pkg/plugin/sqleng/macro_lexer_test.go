@@ -0,0 +1,104 @@
+package sqleng
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindMacroCalls(t *testing.T) {
+	type call struct {
+		name string
+		args []string
+	}
+	calls := func(sql string) []call {
+		var result []call
+		for _, c := range FindMacroCalls(sql) {
+			result = append(result, call{c.Name, c.Args})
+		}
+		return result
+	}
+
+	t.Run("Should keep nested parentheses and commas inside arguments", func(t *testing.T) {
+		require.Equal(t, []call{{"__timeFilter", []string{"coalesce(a, b)"}}}, calls("WHERE $__timeFilter(coalesce(a, b))"))
+		require.Equal(t, []call{{"__timeGroup", []string{"date_trunc('hour', ts)", "1h"}}}, calls("SELECT $__timeGroup(date_trunc('hour', ts), 1h)"))
+		require.Equal(t, []call{{"__timeGroup", []string{"\"my)col\"", "'1h'"}}}, calls(`SELECT $__timeGroup("my)col", '1h')`))
+		require.Equal(t, []call{{"__timeFrom", []string{""}}, {"__timeTo", []string{""}}}, calls("BETWEEN $__timeFrom() AND $__timeTo()"))
+		require.Equal(t, []call{{"__histogram", []string{"x", "[1, 2]"}}}, calls("SELECT $__histogram(x, [1, 2])"))
+	})
+
+	t.Run("Should skip literals, identifiers and comments", func(t *testing.T) {
+		require.Empty(t, calls("SELECT '$__timeFilter(ts)', 'it''s $__timeTo()'"))
+		require.Empty(t, calls(`SELECT "$__timeFilter(ts)"`))
+		require.Empty(t, calls("SELECT 1 -- $__timeFilter(ts)\n"))
+		require.Empty(t, calls("SELECT /* $__timeFilter(ts) */ 1"))
+		require.Empty(t, calls("SELECT $$ $__timeFilter(ts) $$, $tag$ $__timeTo() $tag$"))
+		require.Equal(t, []call{{"__timeTo", []string{""}}}, calls("SELECT 1 -- $__timeFilter(ts)\nWHERE x < $__timeTo()"))
+	})
+
+	t.Run("Should ignore calls that are never closed", func(t *testing.T) {
+		require.Empty(t, calls("SELECT $__timeFilter(ts"))
+		require.Empty(t, calls("SELECT $__interval, $ 1, $(x)"))
+	})
+
+	t.Run("Should stop at the first error", func(t *testing.T) {
+		_, err := NewSQLMacroEngineBase().ReplaceMacros("$a() $b()", func(call MacroCall) (string, error) {
+			return "", errUnknownColumn
+		})
+		require.ErrorIs(t, err, errUnknownColumn)
+	})
+}
+
+func FuzzReplaceMacros(f *testing.F) {
+	for _, seed := range []string{
+		"SELECT $__timeGroup(date_trunc('hour', ts), 1h), count(*) FROM t WHERE $__timeFilter(coalesce(a, b))",
+		"SELECT '$__timeFilter(ts)' -- $__timeTo()\n/* $x() */ $$ $y() $$",
+		"SELECT $__timeFilter(ts",
+		"$a($b(c), (d, e)) $f()",
+		`"a""b" 'c''d' $g("x)", ')')`,
+	} {
+		f.Add(seed)
+	}
+
+	engine := NewSQLMacroEngineBase()
+	f.Fuzz(func(t *testing.T, sql string) {
+		found := FindMacroCalls(sql)
+		last := 0
+		for _, call := range found {
+			if call.Start < last || call.End <= call.Start || call.End > len(sql) {
+				t.Fatalf("invalid call offsets %d-%d after %d in %q", call.Start, call.End, last, sql)
+			}
+			if sql[call.Start] != '$' || sql[call.End-1] != ')' || !strings.HasPrefix(sql[call.Start+1:], call.Name+"(") {
+				t.Fatalf("call %q does not match %q", sql[call.Start:call.End], call.Name)
+			}
+			if len(call.Args) == 0 {
+				t.Fatalf("call %q has no arguments", sql[call.Start:call.End])
+			}
+			last = call.End
+		}
+
+		// replacing every call with itself gives back the query
+		same, err := engine.ReplaceMacros(sql, func(call MacroCall) (string, error) {
+			return sql[call.Start:call.End], nil
+		})
+		if err != nil || same != sql {
+			t.Fatalf("identity replacement changed %q into %q (%v)", sql, same, err)
+		}
+
+		// a replaced query does not contain the calls anymore
+		replaced, err := engine.ReplaceMacros(sql, func(call MacroCall) (string, error) {
+			return "", nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		removed := 0
+		for _, call := range found {
+			removed += call.End - call.Start
+		}
+		if len(replaced) != len(sql)-removed {
+			t.Fatalf("removing the calls of %q left %q", sql, replaced)
+		}
+	})
+}
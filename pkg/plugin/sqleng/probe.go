@@ -0,0 +1,208 @@
+package sqleng
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// The bounds of the delay before a database file that failed to load is tried again, the delay doubles with
+// every failure
+const (
+	minReloadBackoff = time.Second
+	maxReloadBackoff = 5 * time.Minute
+)
+
+// loadFailure is a database file that failed to open, to warm up or to pass the probe
+type loadFailure struct {
+	modTime  time.Time
+	err      error
+	attempts int
+	retryAt  time.Time
+}
+
+// loadFailures remembers the files that failed to load by path, so that they are tried again with a backoff. The
+// zero value is ready to use.
+type loadFailures struct {
+	mu       sync.Mutex
+	failures map[string]*loadFailure
+	// stale explains why the current generation is not the newest one, "" when it is
+	stale string
+}
+
+// pending returns the failure of the file if it is to be tried again later. A modified file is tried right away.
+func (f *loadFailures) pending(path string, modTime time.Time, now time.Time) *loadFailure {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	failure := f.failures[path]
+	if failure == nil || !failure.modTime.Equal(modTime) || !now.Before(failure.retryAt) {
+		return nil
+	}
+	return failure
+}
+
+// record remembers a failure of the file and returns the delay before it is tried again
+func (f *loadFailures) record(path string, modTime time.Time, err error, now time.Time) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures == nil {
+		f.failures = map[string]*loadFailure{}
+	}
+	failure := f.failures[path]
+	if failure == nil || !failure.modTime.Equal(modTime) {
+		failure = &loadFailure{modTime: modTime}
+		f.failures[path] = failure
+	}
+	backoff := maxReloadBackoff
+	if failure.attempts < 20 {
+		backoff = min(minReloadBackoff<<failure.attempts, maxReloadBackoff)
+	}
+	failure.attempts++
+	failure.err = err
+	failure.retryAt = now.Add(backoff)
+	return backoff
+}
+
+func (f *loadFailures) forget(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.failures, path)
+}
+
+func (f *loadFailures) setStale(reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stale = reason
+}
+
+func (f *loadFailures) staleReason() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stale
+}
+
+func validateProbeSettings(jsonData JsonData) error {
+	if jsonData.ProbeQuery == "" && (jsonData.ProbeMinRows != 0 || jsonData.ProbeMaxAge != "") {
+		return fmt.Errorf("the probe assertions need a probe query")
+	}
+	if jsonData.ProbeMinRows < 0 {
+		return fmt.Errorf("invalid probe minimum rows %d", jsonData.ProbeMinRows)
+	}
+	if jsonData.ProbeMaxAge != "" {
+		if _, err := gtime.ParseDuration(jsonData.ProbeMaxAge); err != nil {
+			return fmt.Errorf("invalid probe maximum age %q", jsonData.ProbeMaxAge)
+		}
+	}
+	return nil
+}
+
+// probeDatabase runs the probe query on a new generation before it is served. The first row of the result must
+// have no false boolean column, its first integer column must be at least ProbeMinRows and its first time column
+// must be at most ProbeMaxAge old, e.g. for SELECT count(*), max(ts) FROM facts.
+func (e *DataSourceHandler) probeDatabase(ctx context.Context, db *sql.DB, now time.Time) error {
+	rows, err := db.QueryContext(ctx, e.dsInfo.JsonData.ProbeQuery)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			e.log.Warn("Failed to close rows", "err", err)
+		}
+	}()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("the probe query returned no rows")
+	}
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return err
+	}
+
+	var count *int64
+	var latest *time.Time
+	for i, value := range values {
+		switch value := value.(type) {
+		case bool:
+			if !value {
+				return fmt.Errorf("the probe column %q is false", columns[i])
+			}
+		case int64, int32, int16, int8, uint64, uint32, uint16, uint8:
+			if count == nil {
+				n := toInt64(value)
+				count = &n
+			}
+		case time.Time:
+			if latest == nil {
+				latest = &value
+			}
+		}
+	}
+
+	if minRows := e.dsInfo.JsonData.ProbeMinRows; minRows > 0 {
+		if count == nil {
+			return fmt.Errorf("the probe query returned no count")
+		}
+		if *count < minRows {
+			return fmt.Errorf("the probe query counted %d rows, fewer than %d", *count, minRows)
+		}
+	}
+	if e.dsInfo.JsonData.ProbeMaxAge != "" {
+		maxAge, err := gtime.ParseDuration(e.dsInfo.JsonData.ProbeMaxAge)
+		if err != nil {
+			return err
+		}
+		if latest == nil {
+			return fmt.Errorf("the probe query returned no time")
+		}
+		if age := now.Sub(*latest); age > maxAge {
+			return fmt.Errorf("the newest data of the probe query is from %s, older than %s", latest.Format(time.RFC3339), e.dsInfo.JsonData.ProbeMaxAge)
+		}
+	}
+	return nil
+}
+
+func toInt64(value any) int64 {
+	switch value := value.(type) {
+	case int64:
+		return value
+	case int32:
+		return int64(value)
+	case int16:
+		return int64(value)
+	case int8:
+		return int64(value)
+	case uint64:
+		return int64(value)
+	case uint32:
+		return int64(value)
+	case uint16:
+		return int64(value)
+	case uint8:
+		return int64(value)
+	}
+	return 0
+}
+
+// appendStaleNotice warns on every frame when a newer database file failed to load and an older generation is
+// served instead
+func (e *DataSourceHandler) appendStaleNotice(frames data.Frames) {
+	if reason := e.loadFailures.staleReason(); reason != "" {
+		appendNotices(frames, []data.Notice{{Severity: data.NoticeSeverityWarning, Text: reason}})
+	}
+}
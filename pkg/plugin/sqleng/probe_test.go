@@ -0,0 +1,170 @@
+package sqleng
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+// replaceDatabase writes a new database with the given number of facts next to the path and moves it over the path,
+// the way an upstream job replaces the file
+func replaceDatabase(t *testing.T, path string, facts int, modTime time.Time) {
+	t.Helper()
+	next := path + ".next"
+	db, err := sql.Open("duckdb", next)
+	require.NoError(t, err)
+	_, err = db.Exec(fmt.Sprintf("CREATE TABLE facts AS SELECT range AS value, TIMESTAMP '2026-10-17 06:00:00' AS ts FROM range(%d)", facts))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.NoError(t, os.Chtimes(next, modTime, modTime))
+	require.NoError(t, os.Rename(next, path))
+}
+
+func TestProbe(t *testing.T) {
+	t.Run("Should back off exponentially until the file is modified", func(t *testing.T) {
+		var failures loadFailures
+		now := time.Now()
+		modTime := now.Add(-time.Hour)
+		require.Nil(t, failures.pending("a", modTime, now))
+
+		require.Equal(t, time.Second, failures.record("a", modTime, errors.New("broken"), now))
+		require.Equal(t, 2*time.Second, failures.record("a", modTime, errors.New("broken"), now))
+		require.Equal(t, 4*time.Second, failures.record("a", modTime, errors.New("broken"), now))
+		require.NotNil(t, failures.pending("a", modTime, now.Add(3*time.Second)))
+		require.Nil(t, failures.pending("a", modTime, now.Add(4*time.Second)))
+		require.Nil(t, failures.pending("a", modTime.Add(time.Second), now))
+
+		for i := 0; i < 30; i++ {
+			failures.record("a", modTime, errors.New("broken"), now)
+		}
+		require.Equal(t, maxReloadBackoff, failures.record("a", modTime, errors.New("broken"), now))
+		require.Equal(t, time.Second, failures.record("a", modTime.Add(time.Second), errors.New("broken"), now))
+	})
+
+	t.Run("Should check the assertions on the first row", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{}, "CREATE TABLE facts AS SELECT range AS value, TIMESTAMP '2026-10-17 06:00:00' AS ts FROM range(10)")
+		now := time.Date(2026, 10, 17, 7, 0, 0, 0, time.UTC)
+		probe := func(jsonData JsonData) error {
+			require.NoError(t, validateProbeSettings(jsonData))
+			handler.dsInfo.JsonData = jsonData
+			return handler.probeDatabase(context.Background(), handler.db, now)
+		}
+
+		require.NoError(t, probe(JsonData{ProbeQuery: "SELECT count(*), max(ts) FROM facts", ProbeMinRows: 10, ProbeMaxAge: "2h"}))
+		require.ErrorContains(t, probe(JsonData{ProbeQuery: "SELECT count(*) FROM facts", ProbeMinRows: 11}), "fewer than 11")
+		require.ErrorContains(t, probe(JsonData{ProbeQuery: "SELECT max(ts) FROM facts", ProbeMaxAge: "30m"}), "older than 30m")
+		require.ErrorContains(t, probe(JsonData{ProbeQuery: "SELECT count(*) > 100 AS enough FROM facts"}), `"enough" is false`)
+		require.ErrorContains(t, probe(JsonData{ProbeQuery: "SELECT * FROM facts WHERE value < 0"}), "no rows")
+		require.ErrorContains(t, probe(JsonData{ProbeQuery: "SELECT 'ok'", ProbeMinRows: 1}), "no count")
+		require.Error(t, validateProbeSettings(JsonData{ProbeMinRows: 1}))
+		require.Error(t, validateProbeSettings(JsonData{ProbeQuery: "SELECT 1", ProbeMaxAge: "soon"}))
+	})
+
+	t.Run("Should keep serving the previous file until a new one passes the probe", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "facts.duckdb")
+		modTime := time.Now().Add(-time.Hour)
+		replaceDatabase(t, path, 10, modTime)
+
+		jsonData := JsonData{Database: path, ReloadAutomatically: true, ProbeQuery: "SELECT count(*) FROM facts", ProbeMinRows: 5}
+		handler, err := NewQueryDataHandler("", DataPluginConfiguration{
+			DSInfo:            DataSourceInfo{JsonData: jsonData, Database: path},
+			MetricColumnTypes: []string{"UNKNOWN", "TEXT", "VARCHAR", "CHAR", "ENUM"},
+			RowLimit:          1000000,
+		}, &testQueryResultTransformer{}, &testMacroEngine{}, backend.NewLoggerWith("logger", "test"))
+		require.NoError(t, err)
+		t.Cleanup(handler.Dispose)
+
+		count := func(t *testing.T) (int64, []data.Notice) {
+			resp := queryData(t, handler, backend.DataQuery{JSON: []byte(`{"rawSql": "SELECT count(*) AS n FROM facts", "format": "table"}`)})
+			require.NoError(t, resp.Error)
+			frame := resp.Frames[0]
+			return *frame.Fields[0].At(0).(*int64), frame.Meta.Notices
+		}
+		health := func(t *testing.T) *backend.CheckHealthResult {
+			res, err := handler.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+			require.NoError(t, err)
+			return res
+		}
+
+		// a file with too few rows is not swapped in
+		replaceDatabase(t, path, 2, modTime.Add(time.Minute))
+		n, notices := count(t)
+		require.Equal(t, int64(10), n)
+		require.Len(t, notices, 1)
+		require.Equal(t, data.NoticeSeverityWarning, notices[0].Severity)
+		require.Contains(t, notices[0].Text, "fewer than 5")
+		res := health(t)
+		require.Equal(t, backend.HealthStatusOk, res.Status)
+		require.Contains(t, res.Message, "Database Connection OK")
+		require.Contains(t, res.Message, "Warning: serving the database modified at")
+		require.Contains(t, res.Message, "fewer than 5")
+
+		// a truncated file neither
+		require.NoError(t, os.WriteFile(path, []byte("truncated"), 0o600))
+		require.NoError(t, os.Chtimes(path, modTime.Add(2*time.Minute), modTime.Add(2*time.Minute)))
+		n, notices = count(t)
+		require.Equal(t, int64(10), n)
+		require.Len(t, notices, 1)
+
+		// the next good file is served right away
+		replaceDatabase(t, path, 20, modTime.Add(3*time.Minute))
+		n, notices = count(t)
+		require.Equal(t, int64(20), n)
+		require.Empty(t, notices)
+		res = health(t)
+		require.Equal(t, backend.HealthStatusOk, res.Status)
+		require.NotContains(t, res.Message, "Warning")
+	})
+
+	t.Run("Should connect to a new file before it is swapped in without a probe", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "facts.duckdb")
+		modTime := time.Now().Add(-time.Hour)
+		replaceDatabase(t, path, 10, modTime)
+
+		handler := &DataSourceHandler{
+			dsInfo: DataSourceInfo{Database: path, JsonData: JsonData{Database: path, ReloadAutomatically: true, PreSql: "CREATE TEMP VIEW recent AS SELECT * FROM facts"}},
+			log:    backend.NewLoggerWith("logger", "test"),
+		}
+		require.NoError(t, handler.maybeReloadDatabase())
+		t.Cleanup(handler.Dispose)
+		served := handler.db
+
+		// the PreSql of the first connection fails on a file without the table
+		next := path + ".next"
+		db, err := sql.Open("duckdb", next)
+		require.NoError(t, err)
+		_, err = db.Exec("CREATE TABLE other AS SELECT 1 AS value")
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+		require.NoError(t, os.Chtimes(next, modTime.Add(time.Minute), modTime.Add(time.Minute)))
+		require.NoError(t, os.Rename(next, path))
+		require.NoError(t, handler.maybeReloadDatabase())
+		require.Same(t, served, handler.db)
+		require.Contains(t, handler.loadFailures.staleReason(), "the new file failed to load")
+		require.NoError(t, handler.Ping())
+	})
+
+	t.Run("Should serve an older snapshot when the newest one fails the probe", func(t *testing.T) {
+		dir := t.TempDir()
+		replaceDatabase(t, filepath.Join(dir, "facts-2026-10-17T06.duckdb"), 10, time.Now())
+		replaceDatabase(t, filepath.Join(dir, "facts-2026-10-17T07.duckdb"), 2, time.Now())
+
+		handler := &DataSourceHandler{
+			dsInfo: DataSourceInfo{Database: dir, JsonData: JsonData{ProbeQuery: "SELECT count(*) FROM facts", ProbeMinRows: 5}},
+			log:    backend.NewLoggerWith("logger", "test"),
+		}
+		require.NoError(t, handler.maybeReloadDatabase())
+		t.Cleanup(handler.Dispose)
+		require.Equal(t, "facts-2026-10-17T06", handler.snapshots[0].name)
+		require.Contains(t, handler.loadFailures.staleReason(), "snapshot facts-2026-10-17T07 failed to load")
+	})
+}
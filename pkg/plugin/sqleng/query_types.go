@@ -0,0 +1,118 @@
+package sqleng
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
+)
+
+// Query types understood by the datasource. Queries without a query type are raw SQL queries, which is what
+// dashboards saved before query types existed send.
+const (
+	queryTypeSQL        = "sql"
+	queryTypeBuilder    = "builder"
+	queryTypeAnnotation = "annotation"
+	queryTypeVariable   = "variable"
+	queryTypeLogs       = "logs"
+)
+
+func (e *DataSourceHandler) newQueryTypeMux() *datasource.QueryTypeMux {
+	mux := datasource.NewQueryTypeMux()
+	mux.HandleFunc("", e.handleFallbackQuery)
+	mux.HandleFunc(queryTypeSQL, e.handleSQLQuery)
+	// builder queries are compiled from their structured query, see compileBuilderQuery
+	mux.HandleFunc(queryTypeBuilder, e.handleSQLQuery)
+	mux.HandleFunc(queryTypeAnnotation, e.handleAnnotationQuery)
+	mux.HandleFunc(queryTypeVariable, e.handleVariableQuery)
+	mux.HandleFunc(queryTypeLogs, e.handleLogsQuery)
+	return mux
+}
+
+// handleFallbackQuery receives the queries without a query type, which are raw SQL, and the queries of unknown
+// types, which are answered with a bad request without failing the rest of the request.
+func (e *DataSourceHandler) handleFallbackQuery(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	var sqlQueries []backend.DataQuery
+	unknown := backend.NewQueryDataResponse()
+	for _, query := range req.Queries {
+		if query.QueryType == "" {
+			sqlQueries = append(sqlQueries, query)
+			continue
+		}
+		unknown.Responses[query.RefID] = backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("unknown query type %q", query.QueryType))
+	}
+
+	if len(sqlQueries) == 0 {
+		return unknown, nil
+	}
+
+	resp, err := e.handleSQLQuery(ctx, &backend.QueryDataRequest{
+		PluginContext: req.PluginContext,
+		Headers:       req.Headers,
+		Queries:       sqlQueries,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for refID, res := range unknown.Responses {
+		resp.Responses[refID] = res
+	}
+	return resp, nil
+}
+
+// handleAnnotationQuery runs annotation queries as tables. The time and timeend columns are converted to times
+// and timeend is renamed to the timeEnd field Grafana maps to the annotation end.
+func (e *DataSourceHandler) handleAnnotationQuery(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	resp, err := e.handleSQLQueryWithFormat(ctx, req, dataQueryFormatTable)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, res := range resp.Responses {
+		for _, frame := range res.Frames {
+			for _, field := range frame.Fields {
+				if field.Name == "timeend" {
+					field.Name = "timeEnd"
+				}
+			}
+		}
+	}
+	return resp, nil
+}
+
+// handleLogsQuery runs queries of the logs query type with the logs format, whatever format they were saved with.
+func (e *DataSourceHandler) handleLogsQuery(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	return e.handleSQLQueryWithFormat(ctx, req, dataQueryFormatLogs)
+}
+
+// handleSQLQueryWithFormat runs the queries as raw SQL with the format overwritten.
+func (e *DataSourceHandler) handleSQLQueryWithFormat(ctx context.Context, req *backend.QueryDataRequest, format dataQueryFormat) (*backend.QueryDataResponse, error) {
+	queries := make([]backend.DataQuery, len(req.Queries))
+	for i, query := range req.Queries {
+		// invalid query JSON is left alone, handleSQLQuery reports it for this query only
+		if raw, err := setQueryJSONProperty(query.JSON, "format", string(format)); err == nil {
+			query.JSON = raw
+		}
+		queries[i] = query
+	}
+
+	return e.handleSQLQuery(ctx, &backend.QueryDataRequest{
+		PluginContext: req.PluginContext,
+		Headers:       req.Headers,
+		Queries:       queries,
+	})
+}
+
+// setQueryJSONProperty overwrites a single property of the query model
+func setQueryJSONProperty(raw json.RawMessage, key string, value any) (json.RawMessage, error) {
+	rawQueryProp := make(map[string]any)
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &rawQueryProp); err != nil {
+			return nil, err
+		}
+	}
+	rawQueryProp[key] = value
+	return json.Marshal(rawQueryProp)
+}
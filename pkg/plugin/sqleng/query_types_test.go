@@ -0,0 +1,55 @@
+package sqleng
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryTypes(t *testing.T) {
+	handler := newTestHandler(t, JsonData{},
+		"CREATE TABLE events (time TIMESTAMP, timeend TIMESTAMP, text VARCHAR, level VARCHAR)",
+		"INSERT INTO events VALUES ('2024-01-01 00:00:00', '2024-01-01 01:00:00', 'deploy', 'info')",
+	)
+
+	resp, err := handler.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{RefID: "raw", JSON: []byte(`{"rawSql": "SELECT text FROM events", "format": "table"}`)},
+			{RefID: "sql", QueryType: queryTypeSQL, JSON: []byte(`{"rawSql": "SELECT text FROM events", "format": "table"}`)},
+			{RefID: "annotation", QueryType: queryTypeAnnotation, JSON: []byte(`{"rawSql": "SELECT * FROM events", "format": "time_series"}`)},
+			{RefID: "logs", QueryType: queryTypeLogs, JSON: []byte(`{"rawSql": "SELECT time, text, level FROM events"}`)},
+			{RefID: "unknown", QueryType: "promql", JSON: []byte(`{"rawSql": "SELECT 1"}`)},
+			{RefID: "invalid", JSON: []byte(`{"rawSql": 1}`)},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Responses, 6)
+
+	t.Run("Should run raw SQL with and without a query type", func(t *testing.T) {
+		for _, refID := range []string{"raw", "sql"} {
+			require.NoError(t, resp.Responses[refID].Error)
+			require.Equal(t, "deploy", *resp.Responses[refID].Frames[0].Fields[0].At(0).(*string))
+		}
+	})
+
+	t.Run("Should return annotation frames with a timeEnd field", func(t *testing.T) {
+		res := resp.Responses["annotation"]
+		require.NoError(t, res.Error)
+		require.Equal(t, []string{"time", "timeEnd", "text", "level"}, fieldNames(res.Frames[0]))
+	})
+
+	t.Run("Should return log frames for the logs query type", func(t *testing.T) {
+		res := resp.Responses["logs"]
+		require.NoError(t, res.Error)
+		require.Equal(t, data.FrameTypeLogLines, res.Frames[0].Meta.Type)
+	})
+
+	t.Run("Should answer unknown query types and invalid queries with a bad request", func(t *testing.T) {
+		require.Equal(t, backend.StatusBadRequest, resp.Responses["unknown"].Status)
+		require.ErrorContains(t, resp.Responses["unknown"].Error, `unknown query type "promql"`)
+		require.Equal(t, backend.StatusBadRequest, resp.Responses["invalid"].Status)
+	})
+}
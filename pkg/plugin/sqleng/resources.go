@@ -0,0 +1,55 @@
+package sqleng
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+)
+
+func (e *DataSourceHandler) newResourceHandler() backend.CallResourceHandler {
+	router := mux.NewRouter()
+	router.HandleFunc("/extensions", e.getExtensions).Methods("GET")
+	router.HandleFunc("/tag-keys", e.getTagKeys).Methods("GET")
+	router.HandleFunc("/tag-values", e.getTagValues).Methods("GET")
+	return httpadapter.New(router)
+}
+
+func (e *DataSourceHandler) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	e.log.Debug("call resource", "path", req.Path)
+	if err := e.maybeReloadDatabase(); err != nil {
+		return err
+	}
+	return e.resourceHandler.CallResource(ctx, req, sender)
+}
+
+func (e *DataSourceHandler) getExtensions(rw http.ResponseWriter, req *http.Request) {
+	extensions, err := e.listExtensions(req.Context())
+	if err != nil {
+		e.log.Error("error listing extensions", "error", err)
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeResourceJSON(rw, extensions)
+}
+
+func writeResourceJSON(rw http.ResponseWriter, v any) {
+	responseBody, err := json.Marshal(v)
+	if err != nil {
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write(responseBody)
+}
+
+func writeResourceError(rw http.ResponseWriter, status int, err error) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	responseBody, _ := json.Marshal(map[string]string{"error": err.Error()})
+	_, _ = rw.Write(responseBody)
+}
@@ -0,0 +1,88 @@
+package sqleng
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+)
+
+// Rollup is a table holding the data of a base table pre-aggregated to a resolution. The raw data has resolution 0.
+type Rollup struct {
+	Table      string
+	Resolution time.Duration
+}
+
+// ParseRollups parses the rollups of the datasource settings. The rollups of every base table are sorted from
+// the finest to the coarsest resolution.
+func ParseRollups(settings map[string]map[string]string) (map[string][]Rollup, error) {
+	rollups := make(map[string][]Rollup, len(settings))
+	for base, tables := range settings {
+		if len(tables) == 0 {
+			return nil, fmt.Errorf("no rollup tables configured for %q", base)
+		}
+		for table, resolution := range tables {
+			rollup := Rollup{Table: table}
+			if resolution = strings.TrimSpace(resolution); resolution != "" && resolution != "raw" {
+				duration, err := gtime.ParseDuration(resolution)
+				if err != nil || duration < 0 {
+					return nil, fmt.Errorf("invalid resolution %q of rollup table %q", resolution, table)
+				}
+				rollup.Resolution = duration
+			}
+			rollups[base] = append(rollups[base], rollup)
+		}
+		slices.SortFunc(rollups[base], func(a, b Rollup) int {
+			if a.Resolution != b.Resolution {
+				return int(a.Resolution - b.Resolution)
+			}
+			return strings.Compare(a.Table, b.Table)
+		})
+	}
+	return rollups, nil
+}
+
+// ChooseRollup returns the coarsest rollup whose resolution is at most interval. When every rollup is coarser,
+// the finest one is returned.
+func ChooseRollup(rollups []Rollup, interval time.Duration) Rollup {
+	chosen := rollups[0]
+	for _, rollup := range rollups[1:] {
+		if rollup.Resolution <= interval {
+			chosen = rollup
+		}
+	}
+	return chosen
+}
+
+// SetRollupTable records in the query that the base table was read from table, see frameCustomMeta
+func SetRollupTable(query *backend.DataQuery, base string, table string) error {
+	rawQueryProp := make(map[string]any)
+	if err := json.Unmarshal(query.JSON, &rawQueryProp); err != nil {
+		return err
+	}
+	tables, _ := rawQueryProp["rollupTables"].(map[string]any)
+	if tables == nil {
+		tables = make(map[string]any)
+	}
+	tables[base] = table
+	rawQueryProp["rollupTables"] = tables
+
+	var err error
+	query.JSON, err = json.Marshal(rawQueryProp)
+	return err
+}
+
+// rollupTables returns the rollup tables recorded by SetRollupTable
+func rollupTables(query backend.DataQuery) map[string]string {
+	var recorded struct {
+		RollupTables map[string]string `json:"rollupTables"`
+	}
+	if err := json.Unmarshal(query.JSON, &recorded); err != nil {
+		return nil
+	}
+	return recorded.RollupTables
+}
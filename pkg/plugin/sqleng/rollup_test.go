@@ -0,0 +1,44 @@
+package sqleng
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollups(t *testing.T) {
+	rollups, err := ParseRollups(map[string]map[string]string{
+		"metrics": {"metrics_1h": "1h", "metrics_raw": "raw", "metrics_1m": "1m"},
+		"coarse":  {"coarse_5m": "5m", "coarse_1d": "1d"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []Rollup{{"metrics_raw", 0}, {"metrics_1m", time.Minute}, {"metrics_1h", time.Hour}}, rollups["metrics"])
+
+	t.Run("Should choose the coarsest rollup within the interval", func(t *testing.T) {
+		require.Equal(t, "metrics_raw", ChooseRollup(rollups["metrics"], 0).Table)
+		require.Equal(t, "metrics_raw", ChooseRollup(rollups["metrics"], 30*time.Second).Table)
+		require.Equal(t, "metrics_1m", ChooseRollup(rollups["metrics"], 20*time.Minute).Table)
+		require.Equal(t, "metrics_1h", ChooseRollup(rollups["metrics"], 24*time.Hour).Table)
+		require.Equal(t, "coarse_5m", ChooseRollup(rollups["coarse"], time.Minute).Table)
+	})
+
+	t.Run("Should reject invalid settings", func(t *testing.T) {
+		_, err := ParseRollups(map[string]map[string]string{"metrics": {"metrics_1m": "a minute"}})
+		require.Error(t, err)
+		_, err = ParseRollups(map[string]map[string]string{"metrics": {}})
+		require.Error(t, err)
+	})
+
+	t.Run("Should record the chosen tables in the frame meta", func(t *testing.T) {
+		query := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "SELECT 1 AS value", "format": "table"}`)}
+		require.NoError(t, SetRollupTable(&query, "metrics", "metrics_1m"))
+		require.NoError(t, SetRollupTable(&query, "events", "events_raw"))
+
+		handler := newTestHandler(t, JsonData{})
+		resp := queryData(t, handler, query)
+		require.NoError(t, resp.Error)
+		require.Equal(t, frameCustomMeta{RollupTables: map[string]string{"metrics": "metrics_1m", "events": "events_raw"}}, resp.Frames[0].Meta.Custom)
+	})
+}
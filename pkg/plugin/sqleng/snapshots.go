@@ -0,0 +1,278 @@
+package sqleng
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+)
+
+// defaultSnapshotPattern matches the snapshots of a database directory when the SnapshotPattern setting is empty
+const defaultSnapshotPattern = "*.duckdb"
+
+// snapshotTimestampRegex finds a timestamp such as 2026-10-17T06, 2026-10-17T06:30 or 20261017T063000 in a name
+var snapshotTimestampRegex = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})(?:[T_ ]?(\d{2})(?:[:\-]?(\d{2})(?:[:\-]?(\d{2}))?)?)?`)
+
+// snapshotFile is a database file of a snapshot directory
+type snapshotFile struct {
+	// name is the file name without the extension, e.g. sales-2026-10-17T06
+	name    string
+	path    string
+	size    int64
+	modTime time.Time
+	// taken is the time embedded in the name, or the modification time for names without one
+	taken time.Time
+}
+
+// openSnapshot is a snapshot kept open by the retention
+type openSnapshot struct {
+	snapshotFile
+	db *sql.DB
+}
+
+func snapshotName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// snapshotTimestamp reads the timestamp embedded in a snapshot name, down to the hour, minute or second
+func snapshotTimestamp(name string) (time.Time, bool) {
+	match := snapshotTimestampRegex.FindStringSubmatch(name)
+	if match == nil {
+		return time.Time{}, false
+	}
+	digits := strings.Join(match[1:], "")
+	taken, err := time.ParseInLocation("20060102150405"[:len(digits)], digits, time.UTC)
+	return taken, err == nil
+}
+
+func validateSnapshotSettings(jsonData JsonData) error {
+	if _, err := filepath.Match(jsonData.SnapshotPattern, ""); err != nil {
+		return fmt.Errorf("invalid snapshot pattern %q", jsonData.SnapshotPattern)
+	}
+	if jsonData.SnapshotRetention < 0 {
+		return fmt.Errorf("invalid snapshot retention %d", jsonData.SnapshotRetention)
+	}
+	if jsonData.SnapshotMinAge != "" {
+		if _, err := gtime.ParseDuration(jsonData.SnapshotMinAge); err != nil {
+			return fmt.Errorf("invalid snapshot minimum age %q", jsonData.SnapshotMinAge)
+		}
+	}
+	return nil
+}
+
+// findSnapshots lists the snapshots of the directory matching the pattern, from the newest to the oldest. Files
+// modified less than minAge ago may still be written and are left out.
+func findSnapshots(dir string, pattern string, minAge time.Duration, now time.Time) ([]snapshotFile, error) {
+	if pattern == "" {
+		pattern = defaultSnapshotPattern
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []snapshotFile
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if ok, err := filepath.Match(pattern, entry.Name()); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// removed in the meantime
+			continue
+		}
+		if minAge > 0 && now.Sub(info.ModTime()) < minAge {
+			continue
+		}
+
+		snapshot := snapshotFile{
+			name:    snapshotName(entry.Name()),
+			path:    filepath.Join(dir, entry.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			taken:   info.ModTime(),
+		}
+		if taken, ok := snapshotTimestamp(snapshot.name); ok {
+			snapshot.taken = taken
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	slices.SortFunc(snapshots, func(a, b snapshotFile) int {
+		if c := b.taken.Compare(a.taken); c != 0 {
+			return c
+		}
+		return strings.Compare(b.name, a.name)
+	})
+	return snapshots, nil
+}
+
+// reloadSnapshots serves the newest snapshot of the database directory and keeps the SnapshotRetention newest ones
+// open for pinned queries. Snapshots that fail to open are skipped, the ones no longer retained are closed. When
+// no snapshot can be found or opened, the retained ones are served on and the datasource is reported stale; only
+// the first load fails.
+func (e *DataSourceHandler) reloadSnapshots() error {
+	e.snapshotsMu.RLock()
+	previous := make(map[string]*openSnapshot, len(e.snapshots))
+	for _, snapshot := range e.snapshots {
+		previous[snapshot.path] = snapshot
+	}
+	serving := ""
+	if len(e.snapshots) > 0 {
+		serving = e.snapshots[0].name
+	}
+	e.snapshotsMu.RUnlock()
+
+	keepServing := func(err error) error {
+		if serving == "" {
+			return err
+		}
+		e.loadFailures.setStale(fmt.Sprintf("serving snapshot %s, %s", serving, err))
+		return nil
+	}
+
+	minAge := time.Duration(0)
+	if e.dsInfo.JsonData.SnapshotMinAge != "" {
+		minAge, _ = gtime.ParseDuration(e.dsInfo.JsonData.SnapshotMinAge)
+	}
+	found, err := findSnapshots(e.dsInfo.Database, e.dsInfo.JsonData.SnapshotPattern, minAge, time.Now())
+	if err != nil {
+		return keepServing(err)
+	}
+	if len(found) == 0 {
+		return keepServing(fmt.Errorf("no snapshots matching %q in %s", e.dsInfo.JsonData.SnapshotPattern, e.dsInfo.Database))
+	}
+
+	retention := max(e.dsInfo.JsonData.SnapshotRetention, 1)
+	var kept []*openSnapshot
+	// stale is why the newest snapshot is not served
+	stale := ""
+	for _, file := range found {
+		if len(kept) == retention {
+			break
+		}
+		if snapshot, ok := previous[file.path]; ok && snapshot.modTime.Equal(file.modTime) {
+			kept = append(kept, snapshot)
+			delete(previous, file.path)
+			continue
+		}
+		backend.Logger.Info("loading snapshot", "snapshot", file.name, "taken", file.taken)
+		db, err := e.openGeneration(file.path, file.size, file.modTime, len(kept) == 0)
+		if err != nil {
+			backend.Logger.Debug("skipping snapshot", "snapshot", file.name, "error", err)
+			if len(kept) == 0 && stale == "" {
+				stale = fmt.Sprintf("snapshot %s failed to load: %s", file.name, err)
+			}
+			continue
+		}
+		kept = append(kept, &openSnapshot{snapshotFile: file, db: db})
+	}
+	if len(kept) == 0 {
+		err := fmt.Errorf("none of the snapshots matching %q in %s could be opened", e.dsInfo.JsonData.SnapshotPattern, e.dsInfo.Database)
+		if stale != "" {
+			err = errors.New(stale)
+		}
+		return keepServing(err)
+	}
+	if stale != "" {
+		stale = fmt.Sprintf("serving snapshot %s, %s", kept[0].name, stale)
+	}
+	e.loadFailures.setStale(stale)
+
+	e.snapshotsMu.Lock()
+	changed := e.db != kept[0].db
+	e.snapshots = kept
+	e.db = kept[0].db
+	e.snapshotsMu.Unlock()
+
+	for _, snapshot := range previous {
+		backend.Logger.Info("closing snapshot", "snapshot", snapshot.name)
+		e.spatialGenerations.Delete(snapshot.db)
+		if err := snapshot.db.Close(); err != nil {
+			backend.Logger.Error("error closing database", "error", err)
+		}
+	}
+	if changed && e.tailCache != nil && !e.dsInfo.JsonData.AppendOnly {
+		e.tailCache.clear()
+	}
+	return nil
+}
+
+// querySnapshot returns the snapshot a query is pinned to by its Snapshot field or by $__snapshot('name'), or ""
+// for the newest one
+func querySnapshot(queryJson QueryJson) string {
+	if queryJson.Snapshot != "" {
+		return queryJson.Snapshot
+	}
+	for _, call := range FindMacroCalls(queryJson.RawSql) {
+		if call.Name == "__snapshot" {
+			if name := strings.Trim(call.Args[0], `'"`); name != "" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// snapshotDatabase returns the database generation of a snapshot and its name. The newest snapshot is returned
+// for an empty name. A database file is not a snapshot, its name is empty.
+func (e *DataSourceHandler) snapshotDatabase(name string) (*sql.DB, string, error) {
+	e.snapshotsMu.RLock()
+	defer e.snapshotsMu.RUnlock()
+	if e.snapshots == nil {
+		if name != "" && name != snapshotName(e.dsInfo.Database) && name != filepath.Base(e.dsInfo.Database) {
+			return nil, "", fmt.Errorf("snapshot %q is not available, the database is the single file %s", name, e.dsInfo.Database)
+		}
+		return e.db, "", nil
+	}
+	if name == "" {
+		return e.snapshots[0].db, e.snapshots[0].name, nil
+	}
+
+	available := make([]string, len(e.snapshots))
+	for i, snapshot := range e.snapshots {
+		if name == snapshot.name || name == filepath.Base(snapshot.path) {
+			return snapshot.db, snapshot.name, nil
+		}
+		available[i] = snapshot.name
+	}
+	return nil, "", fmt.Errorf("snapshot %q is not available, the available snapshots are %s", name, strings.Join(available, ", "))
+}
+
+// setQuerySnapshot records in the query which snapshot it runs on, see QuerySnapshot
+func setQuerySnapshot(query *backend.DataQuery, name string) error {
+	rawQueryProp := make(map[string]any)
+	if err := json.Unmarshal(query.JSON, &rawQueryProp); err != nil {
+		return err
+	}
+	rawQueryProp["snapshot"] = name
+
+	var err error
+	query.JSON, err = json.Marshal(rawQueryProp)
+	return err
+}
+
+// QuerySnapshot returns the name of the snapshot the query runs on, for $__snapshot()
+func QuerySnapshot(query backend.DataQuery) string {
+	var recorded struct {
+		Snapshot string `json:"snapshot"`
+	}
+	if err := json.Unmarshal(query.JSON, &recorded); err != nil {
+		return ""
+	}
+	return recorded.Snapshot
+}
@@ -0,0 +1,173 @@
+package sqleng
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+type snapshotTestMacroEngine struct {
+	SQLMacroEngineBase
+}
+
+func (m *snapshotTestMacroEngine) Interpolate(query *backend.DataQuery, _ backend.TimeRange, sql string) (string, error) {
+	return m.ReplaceMacros(sql, func(call MacroCall) (string, error) {
+		return quoteLiteral(QuerySnapshot(*query)), nil
+	})
+}
+
+// writeSnapshot creates a snapshot holding a single row with its number
+func writeSnapshot(t *testing.T, dir string, name string, number int) {
+	t.Helper()
+	db, err := sql.Open("duckdb", filepath.Join(dir, name))
+	require.NoError(t, err)
+	_, err = db.Exec(fmt.Sprintf("CREATE TABLE sales AS SELECT %d AS number", number))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestSnapshots(t *testing.T) {
+	t.Run("Should read the timestamp embedded in the name", func(t *testing.T) {
+		for name, expected := range map[string]time.Time{
+			"sales-2026-10-17T06":       time.Date(2026, 10, 17, 6, 0, 0, 0, time.UTC),
+			"sales-2026-10-17T06:30":    time.Date(2026, 10, 17, 6, 30, 0, 0, time.UTC),
+			"sales_20261017T063015":     time.Date(2026, 10, 17, 6, 30, 15, 0, time.UTC),
+			"2026-10-17-sales":          time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC),
+			"sales-2026-10-17_06-30-15": time.Date(2026, 10, 17, 6, 30, 15, 0, time.UTC),
+		} {
+			taken, ok := snapshotTimestamp(name)
+			require.True(t, ok, name)
+			require.Equal(t, expected, taken, name)
+		}
+		_, ok := snapshotTimestamp("sales-latest")
+		require.False(t, ok)
+		_, ok = snapshotTimestamp("sales-2026-13-45")
+		require.False(t, ok)
+	})
+
+	t.Run("Should order snapshots from the newest and leave out the ones still written", func(t *testing.T) {
+		dir := t.TempDir()
+		now := time.Now()
+		for _, name := range []string{"sales-2026-10-17T07.duckdb", "sales-2026-10-17T06.duckdb", "sales-2026-10-16T23.duckdb", "notes.txt", "sales-2026-10-17T08.duckdb.wal"} {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o600))
+			require.NoError(t, os.Chtimes(filepath.Join(dir, name), now.Add(-time.Hour), now.Add(-time.Hour)))
+		}
+		require.NoError(t, os.Chtimes(filepath.Join(dir, "sales-2026-10-17T07.duckdb"), now, now))
+
+		found, err := findSnapshots(dir, "sales-*.duckdb", 0, now)
+		require.NoError(t, err)
+		var names []string
+		for _, snapshot := range found {
+			names = append(names, snapshot.name)
+		}
+		require.Equal(t, []string{"sales-2026-10-17T07", "sales-2026-10-17T06", "sales-2026-10-16T23"}, names)
+
+		found, err = findSnapshots(dir, "", time.Minute, now.Add(30*time.Second))
+		require.NoError(t, err)
+		require.Len(t, found, 2)
+		require.Equal(t, "sales-2026-10-17T06", found[0].name)
+	})
+
+	t.Run("Should serve the newest snapshot and keep the retained ones for pinned queries", func(t *testing.T) {
+		dir := t.TempDir()
+		writeSnapshot(t, dir, "sales-2026-10-17T05.duckdb", 5)
+		writeSnapshot(t, dir, "sales-2026-10-17T06.duckdb", 6)
+		writeSnapshot(t, dir, "sales-2026-10-17T07.duckdb", 7)
+		// a table only the older snapshot has
+		db, err := sql.Open("duckdb", filepath.Join(dir, "sales-2026-10-17T06.duckdb"))
+		require.NoError(t, err)
+		_, err = db.Exec("CREATE TABLE legacy AS SELECT 6 AS number")
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+
+		jsonData := JsonData{Database: dir, ReloadAutomatically: true, SnapshotPattern: "sales-*.duckdb", SnapshotRetention: 2}
+		handler, err := NewQueryDataHandler("", DataPluginConfiguration{
+			DSInfo:            DataSourceInfo{JsonData: jsonData, Database: dir},
+			MetricColumnTypes: []string{"UNKNOWN", "TEXT", "VARCHAR", "CHAR", "ENUM"},
+			RowLimit:          1000000,
+		}, &testQueryResultTransformer{}, &snapshotTestMacroEngine{}, backend.NewLoggerWith("logger", "test"))
+		require.NoError(t, err)
+		t.Cleanup(handler.Dispose)
+
+		query := func(t *testing.T, queryJSON string) backend.DataResponse {
+			return queryData(t, handler, backend.DataQuery{JSON: []byte(queryJSON)})
+		}
+		number := func(t *testing.T, resp backend.DataResponse) int32 {
+			require.NoError(t, resp.Error)
+			return *resp.Frames[0].Fields[0].At(0).(*int32)
+		}
+
+		resp := query(t, `{"rawSql": "SELECT number, $__snapshot() AS snapshot FROM sales", "format": "table"}`)
+		require.Equal(t, int32(7), number(t, resp))
+		require.Equal(t, "sales-2026-10-17T07", *resp.Frames[0].Fields[1].At(0).(*string))
+		require.Equal(t, frameCustomMeta{Snapshot: "sales-2026-10-17T07"}, resp.Frames[0].Meta.Custom)
+
+		require.Equal(t, int32(6), number(t, query(t, `{"rawSql": "SELECT number FROM sales", "format": "table", "snapshot": "sales-2026-10-17T06"}`)))
+		require.Equal(t, int32(6), number(t, query(t, `{"rawSql": "SELECT number, $__snapshot('sales-2026-10-17T06.duckdb') FROM sales", "format": "table"}`)))
+		resp = query(t, `{"rawSql": "SELECT number FROM sales", "format": "table", "snapshot": "sales-2026-10-17T05"}`)
+		require.ErrorContains(t, resp.Error, "sales-2026-10-17T07, sales-2026-10-17T06")
+
+		// builder queries and tag keys read the columns of the pinned snapshot
+		builder := `{"format": "table", "table": "legacy", "sql": {"columns": [{"parameters": [{"name": "number"}]}]}, "snapshot": "sales-2026-10-17T06"}`
+		require.Equal(t, int32(6), number(t, query(t, builder)))
+		tagKeys := func(t *testing.T, url string) *backend.CallResourceResponse {
+			sender := &testResourceSender{}
+			require.NoError(t, handler.CallResource(context.Background(), &backend.CallResourceRequest{Method: "GET", Path: "/tag-keys", URL: url}, sender))
+			return sender.response
+		}
+		require.JSONEq(t, `[{"text": "number", "type": "INTEGER"}]`, string(tagKeys(t, "/tag-keys?table=legacy&snapshot=sales-2026-10-17T06").Body))
+		require.JSONEq(t, `[]`, string(tagKeys(t, "/tag-keys?table=legacy").Body))
+		require.Equal(t, http.StatusBadRequest, tagKeys(t, "/tag-keys?table=legacy&snapshot=sales-2026-10-17T05").Status)
+
+		// a new snapshot is served and the oldest retained one is closed
+		retired := handler.snapshots[1].db
+		writeSnapshot(t, dir, "sales-2026-10-17T08.duckdb", 8)
+		require.Equal(t, int32(8), number(t, query(t, `{"rawSql": "SELECT number FROM sales", "format": "table"}`)))
+		require.Equal(t, int32(7), number(t, query(t, `{"rawSql": "SELECT number FROM sales", "format": "table", "snapshot": "sales-2026-10-17T07"}`)))
+		require.Error(t, retired.Ping())
+	})
+
+	t.Run("Should skip snapshots that cannot be opened", func(t *testing.T) {
+		dir := t.TempDir()
+		writeSnapshot(t, dir, "sales-2026-10-17T06.duckdb", 6)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "sales-2026-10-17T07.duckdb"), []byte("truncated"), 0o600))
+
+		handler := &DataSourceHandler{dsInfo: DataSourceInfo{Database: dir}, log: backend.NewLoggerWith("logger", "test")}
+		require.NoError(t, handler.maybeReloadDatabase())
+		t.Cleanup(handler.Dispose)
+		require.Len(t, handler.snapshots, 1)
+		require.Equal(t, "sales-2026-10-17T06", handler.snapshots[0].name)
+	})
+
+	t.Run("Should keep serving the retained snapshots when none can be loaded", func(t *testing.T) {
+		dir := t.TempDir()
+		writeSnapshot(t, dir, "sales-2026-10-17T06.duckdb", 6)
+
+		handler := &DataSourceHandler{dsInfo: DataSourceInfo{Database: dir, JsonData: JsonData{ReloadAutomatically: true}}, log: backend.NewLoggerWith("logger", "test")}
+		require.NoError(t, handler.maybeReloadDatabase())
+		t.Cleanup(handler.Dispose)
+
+		// the served snapshot is removed, the open database stays readable
+		require.NoError(t, os.Remove(filepath.Join(dir, "sales-2026-10-17T06.duckdb")))
+		require.NoError(t, handler.maybeReloadDatabase())
+		require.Contains(t, handler.loadFailures.staleReason(), "serving snapshot sales-2026-10-17T06, no snapshots matching")
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "sales-2026-10-17T07.duckdb"), []byte("truncated"), 0o600))
+		require.NoError(t, handler.maybeReloadDatabase())
+		require.Contains(t, handler.loadFailures.staleReason(), "serving snapshot sales-2026-10-17T06, snapshot sales-2026-10-17T07 failed to load")
+		require.Equal(t, "sales-2026-10-17T06", handler.snapshots[0].name)
+		require.NoError(t, handler.Ping())
+
+		// the first load has nothing to serve
+		empty := &DataSourceHandler{dsInfo: DataSourceInfo{Database: t.TempDir()}, log: backend.NewLoggerWith("logger", "test")}
+		require.ErrorContains(t, empty.maybeReloadDatabase(), "no snapshots matching")
+	})
+}
@@ -0,0 +1,101 @@
+package sqleng
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// splitKey is a value of the split column. NULL is a value of its own, apart from the string "null".
+type splitKey struct {
+	value string
+	null  bool
+}
+
+// name names the frame of the value, the frame of NULL is named "<column> IS NULL"
+func (k splitKey) name(column string) string {
+	if k.null {
+		return column + " IS NULL"
+	}
+	return k.value
+}
+
+// splitFrame splits the frame into one frame per distinct value of the column, in the order the values first
+// appear. The column itself is dropped and the frames are named after its values. The returned query model has
+// its column indexes adjusted to the split frames.
+func splitFrame(frame *data.Frame, column string, qm *dataQueryModel) (data.Frames, *dataQueryModel, error) {
+	splitIndex := -1
+	for i, field := range frame.Fields {
+		if field.Name == column {
+			splitIndex = i
+			break
+		}
+	}
+	if splitIndex == -1 {
+		return nil, nil, fmt.Errorf("split column %q not found in the result", column)
+	}
+
+	var keys []splitKey
+	rowsByKey := make(map[splitKey][]int)
+	for i := 0; i < frame.Rows(); i++ {
+		key := splitKey{null: true}
+		if v, ok := frame.Fields[splitIndex].ConcreteAt(i); ok {
+			key = splitKey{value: toString(v)}
+		}
+		if _, ok := rowsByKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		rowsByKey[key] = append(rowsByKey[key], i)
+	}
+
+	frames := make(data.Frames, 0, len(keys))
+	for _, key := range keys {
+		var fields []*data.Field
+		for i, field := range frame.Fields {
+			if i == splitIndex {
+				continue
+			}
+			split := data.NewFieldFromFieldType(field.Type(), 0)
+			split.Name = field.Name
+			split.Labels = field.Labels.Copy()
+			split.Config = field.Config
+			for _, row := range rowsByKey[key] {
+				split.Append(field.At(row))
+			}
+			fields = append(fields, split)
+		}
+
+		splitFrame := data.NewFrame(key.name(column), fields...)
+		if frame.Meta != nil {
+			meta := *frame.Meta
+			splitFrame.Meta = &meta
+		}
+		frames = append(frames, splitFrame)
+	}
+	return frames, qm.withoutColumn(splitIndex), nil
+}
+
+// withoutColumn returns a copy of the query model for a result without the column at index
+func (qm *dataQueryModel) withoutColumn(index int) *dataQueryModel {
+	shift := func(i int) int {
+		switch {
+		case i == index:
+			return -1
+		case i > index:
+			return i - 1
+		default:
+			return i
+		}
+	}
+
+	model := *qm
+	model.columnNames = append(append([]string{}, qm.columnNames[:index]...), qm.columnNames[index+1:]...)
+	if index < len(qm.columnTypes) {
+		model.columnTypes = append(append([]*sql.ColumnType{}, qm.columnTypes[:index]...), qm.columnTypes[index+1:]...)
+	}
+	model.timeIndex = shift(qm.timeIndex)
+	model.timeEndIndex = shift(qm.timeEndIndex)
+	model.metricIndex = shift(qm.metricIndex)
+	return &model
+}
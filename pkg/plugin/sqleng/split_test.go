@@ -0,0 +1,72 @@
+package sqleng
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitFrame(t *testing.T) {
+	t.Run("Should split by value in order of appearance and adjust the column indexes", func(t *testing.T) {
+		frame := data.NewFrame("",
+			data.NewField("region", nil, []*string{Pointer("eu"), Pointer("us"), nil, Pointer("eu"), Pointer("null")}),
+			data.NewField("time", nil, []int64{1, 2, 3, 4, 5}),
+			data.NewField("value", nil, []float64{1, 2, 3, 4, 5}),
+		)
+		frame.Meta = &data.FrameMeta{ExecutedQueryString: "SELECT 1"}
+		qm := &dataQueryModel{columnNames: []string{"region", "time", "value"}, timeIndex: 1, timeEndIndex: -1, metricIndex: 0}
+
+		frames, splitQm, err := splitFrame(frame, "region", qm)
+		require.NoError(t, err)
+		require.Len(t, frames, 4)
+		require.Equal(t, []string{"eu", "us", "region IS NULL", "null"}, []string{frames[0].Name, frames[1].Name, frames[2].Name, frames[3].Name})
+		require.Equal(t, 1, frames[2].Rows())
+		require.Equal(t, int64(5), frames[3].Fields[0].At(0))
+		require.Equal(t, []string{"time", "value"}, fieldNames(frames[0]))
+		require.Equal(t, []any{int64(1), int64(4)}, []any{frames[0].Fields[0].At(0), frames[0].Fields[0].At(1)})
+		require.Equal(t, "SELECT 1", frames[2].Meta.ExecutedQueryString)
+
+		require.Equal(t, []string{"time", "value"}, splitQm.columnNames)
+		require.Equal(t, 0, splitQm.timeIndex)
+		require.Equal(t, -1, splitQm.metricIndex)
+		require.Equal(t, 1, qm.timeIndex)
+	})
+
+	t.Run("Should fail on a missing split column", func(t *testing.T) {
+		_, _, err := splitFrame(data.NewFrame(""), "region", &dataQueryModel{})
+		require.Error(t, err)
+	})
+
+	handler := newTestHandler(t, JsonData{},
+		"CREATE TABLE metrics (time TIMESTAMP, region VARCHAR, host VARCHAR, value DOUBLE)",
+		`INSERT INTO metrics VALUES
+			('2024-01-01 00:00:00', 'eu', 'a', 1), ('2024-01-01 00:00:00', 'eu', 'b', 2), ('2024-01-01 00:00:00', 'us', 'c', 3),
+			('2024-01-01 00:01:00', 'eu', 'a', 4), ('2024-01-01 00:01:00', 'eu', 'b', 5), ('2024-01-01 00:01:00', 'us', 'c', 6)`,
+	)
+
+	t.Run("Should convert every split frame to a time series on its own", func(t *testing.T) {
+		res := queryData(t, handler, backend.DataQuery{
+			JSON: []byte(`{"rawSql": "SELECT time, region, host, value FROM metrics ORDER BY time, region, host", "format": "time_series", "splitBy": "region"}`),
+		})
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 2)
+
+		eu, us := res.Frames[0], res.Frames[1]
+		require.Equal(t, "eu", eu.Name)
+		require.Equal(t, "us", us.Name)
+		require.Len(t, eu.Fields, 3)
+		require.Len(t, us.Fields, 2)
+		require.Equal(t, 2, eu.Rows())
+		require.Equal(t, data.Labels{"host": "b"}, eu.Fields[2].Labels)
+		require.Equal(t, 6.0, *us.Fields[1].At(1).(*float64))
+	})
+
+	t.Run("Should report a missing split column", func(t *testing.T) {
+		res := queryData(t, handler, backend.DataQuery{
+			JSON: []byte(`{"rawSql": "SELECT time, value FROM metrics", "format": "table", "splitBy": "tenant"}`),
+		})
+		require.ErrorContains(t, res.Error, "tenant")
+	})
+}
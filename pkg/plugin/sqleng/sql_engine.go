@@ -10,11 +10,11 @@ import (
 	"github.com/marcboeker/go-duckdb"
 	"net"
 	"os"
-	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -63,6 +63,49 @@ type JsonData struct {
 	SecureDSProxyUsername   string `json:"secureSocksProxyUsername"`
 	AllowCleartextPasswords bool   `json:"allowCleartextPasswords"`
 	AuthenticationType      string `json:"authenticationType"`
+	// ExtensionDirectory is a local directory holding pre-downloaded extensions, for hosts that cannot INSTALL
+	ExtensionDirectory string `json:"extensionDirectory"`
+	// Extensions are LOADed on every connection and reported as missing by the health check if that fails
+	Extensions []string `json:"extensions"`
+	// GeometryFormat is how spatial columns are returned: "geojson" (the default) or "wkt"
+	GeometryFormat string `json:"geometryFormat"`
+	// AdhocTable is the table offered for ad-hoc filters when the request does not select one
+	AdhocTable string `json:"adhocTable"`
+	// CustomMacros are expanded by the macro engine next to the built-in macros
+	CustomMacros []CustomMacro `json:"customMacros"`
+	// IncrementalQueries caches the buckets of time series queries using $__timeGroup, see runIncremental
+	IncrementalQueries bool `json:"incrementalQueries"`
+	// AppendOnly keeps the cached buckets when a new database generation is loaded, old rows never change
+	AppendOnly bool `json:"appendOnly"`
+	// Rollups map a base table to its rollup tables and their resolution, e.g.
+	// {"metrics": {"metrics_raw": "raw", "metrics_1m": "1m"}}, see ParseRollups
+	Rollups map[string]map[string]string `json:"rollups"`
+	// WarmupQueries are CREATE TEMP TABLE … AS SELECT … statements run on every database generation before it
+	// serves queries, see warmUp
+	WarmupQueries []string `json:"warmupQueries"`
+	// LoadMode is "file" (the default) to read the database file in place, or "memory" to copy it into memory
+	LoadMode string `json:"loadMode"`
+	// MemoryCeiling, e.g. "4GB", is the largest database loaded in memory mode, larger ones are read from the file
+	MemoryCeiling string `json:"memoryCeiling"`
+	// SnapshotPattern matches the snapshots when the database is a directory, "*.duckdb" by default
+	SnapshotPattern string `json:"snapshotPattern"`
+	// SnapshotRetention is the number of the newest snapshots kept open for pinned queries, 1 by default
+	SnapshotRetention int `json:"snapshotRetention"`
+	// SnapshotMinAge, e.g. "30s", leaves out snapshots modified more recently, they may still be written
+	SnapshotMinAge string `json:"snapshotMinAge"`
+	// ProbeQuery checks a new database file before it is served, e.g. SELECT count(*), max(ts) FROM facts, with
+	// the ProbeMinRows and ProbeMaxAge (e.g. "2h") assertions, see probeDatabase
+	ProbeQuery   string `json:"probeQuery"`
+	ProbeMinRows int64  `json:"probeMinRows"`
+	ProbeMaxAge  string `json:"probeMaxAge"`
+}
+
+// CustomMacro is a macro defined in the datasource settings. Invoking $name(a, b) expands the template with the
+// $param placeholders replaced by the arguments.
+type CustomMacro struct {
+	Name     string   `json:"name"`
+	Params   []string `json:"params"`
+	Template string   `json:"template"`
 }
 
 type DataSourceInfo struct {
@@ -95,6 +138,27 @@ type DataSourceHandler struct {
 	dsInfo                 DataSourceInfo
 	rowLimit               int64
 	userError              string
+	resourceHandler        backend.CallResourceHandler
+	queryHandler           backend.QueryDataHandler
+	// querySlots bounds the chunks running at once to the MaxOpenConns setting, nil when unbounded
+	querySlots chan struct{}
+	// tailCache is nil unless the IncrementalQueries setting is on
+	tailCache *tailCache
+	// warmup is the outcome of the warm-up queries on the current database generation
+	warmup atomic.Pointer[warmupResult]
+	// loaded is how the current database generation was loaded
+	loaded atomic.Pointer[loadResult]
+	// spatialGenerations caches whether the spatial extension is loaded by database generation, see
+	// generationSpatialLoaded
+	spatialGenerations sync.Map
+	// reloadMu keeps concurrent requests from loading the same generation twice
+	reloadMu sync.Mutex
+	// snapshots are the open snapshots from the newest to the oldest when the database is a directory, the newest
+	// one is db. snapshotsMu guards them and db.
+	snapshots   []*openSnapshot
+	snapshotsMu sync.RWMutex
+	// loadFailures are the database files that failed to load and are tried again later
+	loadFailures loadFailures
 }
 
 type QueryJson struct {
@@ -104,10 +168,59 @@ type QueryJson struct {
 	FillMode     string  `json:"fillMode"`
 	FillValue    float64 `json:"fillValue"`
 	Format       string  `json:"format"`
+	// Explain runs the query under EXPLAIN ("plan") or EXPLAIN ANALYZE ("analyze") and returns the operator tree
+	Explain string `json:"explain"`
+	// AdhocFilters are applied to the result of the query, see applyAdhocFilters
+	AdhocFilters []AdhocFilter `json:"adhocFilters"`
+	// LegendFormat names the series, e.g. "{{service}} @ {{region}}", see applyLegendFormat
+	LegendFormat string `json:"legendFormat"`
+	// Downsample reduces the rows to what the panel can show, "minmax" or "lttb", see downsampleQuery
+	Downsample string `json:"downsample"`
+	// SeriesShape "long" returns time series as timeseries-long frames instead of wide ones
+	SeriesShape string `json:"seriesShape"`
+	// SplitBy splits the result into one frame per distinct value of this column, see splitFrame
+	SplitBy string `json:"splitBy"`
+	// TimeShift runs the query on an earlier range, e.g. "7d", and moves the result back onto the panel's range
+	TimeShift string `json:"timeShift"`
+	// Chunks splits the time range into this many parts that run at once, see runChunks
+	Chunks int `json:"chunks"`
+	// Snapshot pins the query to a snapshot of a database directory, see snapshotDatabase
+	Snapshot string `json:"snapshot"`
+	// Table, Dataset and Sql are the structured query of the query builder, see compileBuilderQuery
+	Table   string        `json:"table"`
+	Dataset string        `json:"dataset"`
+	Sql     *BuilderQuery `json:"sql"`
 }
 
-func (e *DataSourceHandler) initDatabaseConnection() error {
-	if connector, err := duckdb.NewConnector(fmt.Sprintf("%s?access_mode=read_only", e.dsInfo.Database), func(execer driver.ExecerContext) error {
+// initDatabaseConnection opens a new generation of the database file. In memory, the first connection copies the
+// file into an in-memory database, see copyIntoMemory.
+func (e *DataSourceHandler) initDatabaseConnection(path string, inMemory bool) (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s?access_mode=read_only", path)
+	var loadOnce sync.Once
+	var loadErr error
+	if inMemory {
+		dsn = ""
+	}
+	if connector, err := duckdb.NewConnector(dsn, func(execer driver.ExecerContext) error {
+		// extensions are loaded first so that PreSql can make use of them
+		if err := e.loadExtensions(execer); err != nil {
+			return err
+		}
+
+		if inMemory {
+			// the connections of the generation share the copy
+			loadOnce.Do(func() { loadErr = e.copyIntoMemory(execer, path) })
+			if loadErr != nil {
+				return loadErr
+			}
+		}
+
+		if len(e.dsInfo.JsonData.WarmupQueries) > 0 {
+			if err := attachWarmupCatalog(execer); err != nil {
+				return err
+			}
+		}
+
 		var bootQueries []string
 		if e.dsInfo.JsonData.PreSql != "" {
 			bootQueries = append(bootQueries, e.dsInfo.JsonData.PreSql)
@@ -121,17 +234,19 @@ func (e *DataSourceHandler) initDatabaseConnection() error {
 		return nil
 	}); err != nil {
 		backend.Logger.Error("error creating database connector", "error", err)
-		return err
+		return nil, err
 	} else {
-		db := sql.OpenDB(connector)
-		e.db = db
-		return nil
+		return sql.OpenDB(connector), nil
 	}
 }
 
 // maybeReloadDatabase checks whether the database needs to be reloaded. If ReloadAutomatically==true, then it only
 // reloads when the last-modified timestamp of the database is different from the timestamp of the last loaded database.
+// The new generation is warmed up before it replaces the previous one. A directory holds snapshots of the database,
+// see reloadSnapshots.
 func (e *DataSourceHandler) maybeReloadDatabase() error {
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
 	// if needed (only at init) or if enabled (the default)
 	if e.db == nil || e.dsInfo.JsonData.ReloadAutomatically {
 		verb := "reloading"
@@ -144,29 +259,93 @@ func (e *DataSourceHandler) maybeReloadDatabase() error {
 		// (NOTE: _different_, not _newer_. Rolling back is ok too)
 		if fileInfo, err := os.Stat(e.dsInfo.Database); err != nil {
 			return err
+		} else if fileInfo.IsDir() {
+			return e.reloadSnapshots()
 		} else {
 			lastModified := fileInfo.ModTime()
 			// Not Equal instead of "After" so that we can roll back to older too
 			if !lastModified.Equal(e.dsInfo.lastLoaded) {
 				backend.Logger.Info(verb+" database", "lastModified", lastModified, "lastLoaded", e.dsInfo.lastLoaded)
-				if e.db != nil {
-					if err := e.db.Close(); err != nil {
-						backend.Logger.Error("error closing database", "error", err)
+				db, err := e.openGeneration(e.dsInfo.Database, fileInfo.Size(), lastModified, true)
+				if err != nil {
+					if e.db == nil {
+						backend.Logger.Error("error creating database connection", "error", err)
 						return err
 					}
+					// the previous generation is served until the file is fixed
+					e.loadFailures.setStale(fmt.Sprintf("serving the database modified at %s, the new file failed to load: %s",
+						e.dsInfo.lastLoaded.Format(time.RFC3339), err))
+					return nil
 				}
-				if err := e.initDatabaseConnection(); err != nil {
-					backend.Logger.Error("error creating database connection", "error", err)
-					return err
+				e.loadFailures.setStale("")
+				e.snapshotsMu.Lock()
+				previous := e.db
+				e.db = db
+				e.snapshotsMu.Unlock()
+				if previous != nil {
+					e.spatialGenerations.Delete(previous)
+					if err := previous.Close(); err != nil {
+						backend.Logger.Error("error closing database", "error", err)
+					}
 				}
 				// if load is successful, we save the lastModified time for reference later
 				e.dsInfo.lastLoaded = lastModified
+				if e.tailCache != nil && !e.dsInfo.JsonData.AppendOnly {
+					e.tailCache.clear()
+				}
 			}
 		}
 	}
 	return nil
 }
 
+// openGeneration opens, probes and warms up a generation of a database file. The outcome is reported by the health
+// check for the generation that becomes current. A file that failed to load is only tried again after a backoff,
+// unless it was modified.
+func (e *DataSourceHandler) openGeneration(path string, size int64, modTime time.Time, current bool) (*sql.DB, error) {
+	now := time.Now()
+	if failure := e.loadFailures.pending(path, modTime, now); failure != nil {
+		return nil, fmt.Errorf("%w (retrying at %s)", failure.err, failure.retryAt.Format(time.RFC3339))
+	}
+
+	db, loaded, err := e.openDatabase(path, size)
+	if err == nil {
+		// the first connection opens the file, a broken file fails here and not in the first query after the swap
+		if err = db.PingContext(context.Background()); err == nil && e.dsInfo.JsonData.ProbeQuery != "" {
+			if err = e.probeDatabase(context.Background(), db, now); err != nil {
+				err = fmt.Errorf("probe failed: %w", err)
+			}
+		}
+		if err != nil {
+			if closeErr := db.Close(); closeErr != nil {
+				backend.Logger.Error("error closing database", "error", closeErr)
+			}
+		}
+	}
+	if err != nil {
+		backoff := e.loadFailures.record(path, modTime, err, now)
+		backend.Logger.Error("error loading database", "path", path, "error", err, "retryIn", backoff)
+		return nil, err
+	}
+	e.loadFailures.forget(path)
+	if current {
+		e.loaded.Store(loaded)
+	}
+	if len(e.dsInfo.JsonData.WarmupQueries) > 0 {
+		warmup := e.warmUp(context.Background(), db)
+		if warmup.err != nil {
+			// the generation is served anyway, only the queries reading the warm-up tables fail
+			backend.Logger.Error("error warming up database", "error", warmup.err, "duration", warmup.duration)
+		} else {
+			backend.Logger.Info("warmed up database", "duration", warmup.duration)
+		}
+		if current {
+			e.warmup.Store(warmup)
+		}
+	}
+	return db, nil
+}
+
 func (e *DataSourceHandler) TransformQueryError(logger log.Logger, err error) error {
 	// OpError is the error type usually returned by functions in the net
 	// package. It describes the operation, network type, and address of
@@ -201,6 +380,38 @@ func NewQueryDataHandler(userFacingDefaultError string, config DataPluginConfigu
 		queryDataHandler.metricColumnTypes = config.MetricColumnTypes
 	}
 
+	if config.DSInfo.JsonData.MaxOpenConns > 0 {
+		queryDataHandler.querySlots = make(chan struct{}, config.DSInfo.JsonData.MaxOpenConns)
+	}
+
+	if config.DSInfo.JsonData.IncrementalQueries {
+		queryDataHandler.tailCache = newTailCache()
+	}
+
+	if err := validateExtensionNames(config.DSInfo.JsonData.Extensions); err != nil {
+		return nil, err
+	}
+
+	if err := validateWarmupQueries(config.DSInfo.JsonData.WarmupQueries); err != nil {
+		return nil, err
+	}
+
+	if err := validateLoadMode(config.DSInfo.JsonData); err != nil {
+		return nil, err
+	}
+
+	if err := validateSnapshotSettings(config.DSInfo.JsonData); err != nil {
+		return nil, err
+	}
+
+	if err := validateProbeSettings(config.DSInfo.JsonData); err != nil {
+		return nil, err
+	}
+
+	queryDataHandler.resourceHandler = queryDataHandler.newResourceHandler()
+
+	queryDataHandler.queryHandler = queryDataHandler.newQueryTypeMux()
+
 	if err := queryDataHandler.maybeReloadDatabase(); err != nil {
 		return nil, err
 	}
@@ -214,6 +425,15 @@ type DBDataResponse struct {
 
 func (e *DataSourceHandler) Dispose() {
 	e.log.Debug("Disposing DB...")
+	e.snapshotsMu.Lock()
+	defer e.snapshotsMu.Unlock()
+	for _, snapshot := range e.snapshots {
+		if snapshot.db != e.db {
+			if err := snapshot.db.Close(); err != nil {
+				e.log.Error("Failed to dispose snapshot", "snapshot", snapshot.name, "error", err)
+			}
+		}
+	}
 	if e.db != nil {
 		if err := e.db.Close(); err != nil {
 			e.log.Error("Failed to dispose db", "error", err)
@@ -223,16 +443,26 @@ func (e *DataSourceHandler) Dispose() {
 }
 
 func (e *DataSourceHandler) Ping() error {
-	return e.db.Ping()
+	db, _, err := e.snapshotDatabase("")
+	if err != nil {
+		return err
+	}
+	return db.Ping()
 }
 
 func (e *DataSourceHandler) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	return e.queryHandler.QueryData(ctx, req)
+}
+
+// handleSQLQuery runs the rawSql of every query and converts the results according to their format
+func (e *DataSourceHandler) handleSQLQuery(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
 	result := backend.NewQueryDataResponse()
 
 	if err := e.maybeReloadDatabase(); err != nil {
 		return nil, err
 	}
 
+	fromAlert := isFromAlert(req)
 	ch := make(chan DBDataResponse, len(req.Queries))
 	var wg sync.WaitGroup
 	// Execute each query in a goroutine and wait for them to finish afterwards
@@ -243,22 +473,20 @@ func (e *DataSourceHandler) QueryData(ctx context.Context, req *backend.QueryDat
 		}
 		err := json.Unmarshal(query.JSON, &queryjson)
 		if err != nil {
-			return nil, fmt.Errorf("error unmarshal query json: %w", err)
-		}
-
-		// the fill-params are only stored inside this function, during query-interpolation. we do not support
-		// sending them in "from the outside"
-		if queryjson.Fill || queryjson.FillInterval != 0.0 || queryjson.FillMode != "" || queryjson.FillValue != 0.0 {
-			return nil, fmt.Errorf("query fill-parameters not supported")
+			ch <- DBDataResponse{
+				dataResponse: backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("error unmarshal query json: %v", err)),
+				refID:        query.RefID,
+			}
+			continue
 		}
 
-		if queryjson.RawSql == "" {
+		if queryjson.RawSql == "" && !queryjson.hasBuilderQuery() {
 			continue
 		}
 
 		wg.Add(1)
 		backend.Logger.Info("running the query time!")
-		go e.executeQuery(query, &wg, ctx, ch, queryjson)
+		go e.executeQuery(query, &wg, ctx, ch, queryjson, fromAlert)
 	}
 
 	wg.Wait()
@@ -275,7 +503,7 @@ func (e *DataSourceHandler) QueryData(ctx context.Context, req *backend.QueryDat
 }
 
 func (e *DataSourceHandler) executeQuery(query backend.DataQuery, wg *sync.WaitGroup, queryContext context.Context,
-	ch chan DBDataResponse, queryJson QueryJson) {
+	ch chan DBDataResponse, queryJson QueryJson, fromAlert bool) {
 	defer wg.Done()
 	queryResult := DBDataResponse{
 		dataResponse: backend.DataResponse{},
@@ -298,12 +526,6 @@ func (e *DataSourceHandler) executeQuery(query backend.DataQuery, wg *sync.WaitG
 		}
 	}()
 
-	if queryJson.RawSql == "" {
-		panic("Query model property rawSql should not be empty at this point")
-	}
-
-	timeRange := query.TimeRange
-
 	errAppendDebug := func(frameErr string, err error, query string) {
 		var emptyFrame data.Frame
 		emptyFrame.SetMeta(&data.FrameMeta{
@@ -314,46 +536,52 @@ func (e *DataSourceHandler) executeQuery(query backend.DataQuery, wg *sync.WaitG
 		ch <- queryResult
 	}
 
-	// global substitutions
-	interpolatedQuery := Interpolate(query, timeRange, e.dsInfo.JsonData.TimeInterval, queryJson.RawSql)
-
-	// data source specific substitutions
-	interpolatedQuery, err := e.macroEngine.Interpolate(&query, timeRange, interpolatedQuery)
-	if err != nil {
-		errAppendDebug("interpolation failed", e.TransformQueryError(logger, err), interpolatedQuery)
-		return
+	// builder queries are compiled here, the SQL the query editor generated is only used as a fallback
+	if queryJson.hasBuilderQuery() && (query.QueryType == queryTypeBuilder || queryJson.RawSql == "") {
+		compiled, err := e.compileBuilderQuery(queryContext, queryJson)
+		if err != nil {
+			errAppendDebug("builder query compilation failed", err, "")
+			return
+		}
+		queryJson.RawSql = compiled
 	}
-
-	rows, err := e.db.QueryContext(queryContext, interpolatedQuery)
-	if err != nil {
-		errAppendDebug("db query error", e.TransformQueryError(logger, err), interpolatedQuery)
-		return
+	if queryJson.RawSql == "" {
+		panic("Query model property rawSql should not be empty at this point")
 	}
-	defer func() {
-		if err := rows.Close(); err != nil {
-			logger.Warn("Failed to close rows", "err", err)
-		}
-	}()
 
-	qm, err := e.newProcessCfg(query, queryContext, rows, interpolatedQuery)
-	if err != nil {
-		errAppendDebug("failed to get configurations", err, interpolatedQuery)
-		return
+	// a shifted query reads an earlier range, its times are moved forward again below
+	var timeShift time.Duration
+	var customMeta frameCustomMeta
+	if queryJson.TimeShift != "" {
+		shift, err := ParseTimeShift(queryJson.TimeShift)
+		if err != nil {
+			errAppendDebug("invalid time shift", err, "")
+			return
+		}
+		timeShift = shift
+		customMeta.TimeShift = strings.Trim(strings.TrimSpace(queryJson.TimeShift), `'`)
+		query.TimeRange = shiftTimeRange(query.TimeRange, timeShift)
 	}
 
-	// Convert row.Rows to dataframe
-	converters := e.queryResultTransformer.GetConverterList()
-	frame, err := sqlutil.FrameFromRows(rows, e.rowLimit, converters...)
+	run, err := e.runIncremental(queryContext, query, queryJson)
 	if err != nil {
-		errAppendDebug("convert frame from rows error", err, interpolatedQuery)
+		var stageErr *queryStageError
+		if !errors.As(err, &stageErr) {
+			stageErr = &queryStageError{stage: "running the query failed", err: err}
+		}
+		errAppendDebug(stageErr.stage, stageErr.err, stageErr.query)
 		return
 	}
-
-	if frame.Meta == nil {
-		frame.Meta = &data.FrameMeta{}
+	if run.explained {
+		queryResult.dataResponse.Frames = data.Frames{run.frame}
+		ch <- queryResult
+		return
 	}
-
-	frame.Meta.ExecutedQueryString = interpolatedQuery
+	frame, qm, interpolatedQuery := run.frame, run.qm, run.interpolatedQuery
+	customMeta.RollupTables = rollupTables(run.query)
+	customMeta.Snapshot = run.snapshot
+	downsample := strings.ToLower(queryJson.Downsample)
+	longSeries := strings.ToLower(queryJson.SeriesShape) == seriesShapeLong
 
 	// If no rows were returned, clear any previously set `Fields` with a single empty `data.Field` slice.
 	// Then assign `queryResult.dataResponse.Frames` the current single frame with that single empty Field.
@@ -361,6 +589,10 @@ func (e *DataSourceHandler) executeQuery(query backend.DataQuery, wg *sync.WaitG
 	// additionally-needed frame data stays intact and is correctly passed to our visulization.
 	if frame.Rows() == 0 {
 		frame.Fields = []*data.Field{}
+		setFrameType(frame, emptyFrameType(qm.Format, fromAlert, longSeries))
+		setCustomMeta(data.Frames{frame}, customMeta)
+		appendNotices(data.Frames{frame}, run.notices)
+		e.appendStaleNotice(data.Frames{frame})
 		queryResult.dataResponse.Frames = data.Frames{frame}
 		ch <- queryResult
 		return
@@ -371,78 +603,312 @@ func (e *DataSourceHandler) executeQuery(query backend.DataQuery, wg *sync.WaitG
 		return
 	}
 
-	if qm.Format == dataQueryFormatSeries {
-		// time series has to have time column
-		if qm.timeIndex == -1 {
-			errAppendDebug("db has no time column", errors.New("no time column found"), interpolatedQuery)
+	frames, frameQm := data.Frames{frame}, qm
+	if queryJson.SplitBy != "" {
+		if frames, frameQm, err = splitFrame(frame, queryJson.SplitBy, qm); err != nil {
+			errAppendDebug("splitting the result failed", err, interpolatedQuery)
 			return
 		}
+	}
 
-		// Make sure to name the time field 'Time' to be backward compatible with Grafana pre-v8.
-		frame.Fields[qm.timeIndex].Name = data.TimeSeriesTimeFieldName
-
-		for i := range qm.columnNames {
-			if i == qm.timeIndex || i == qm.metricIndex {
-				continue
-			}
-
-			if t := frame.Fields[i].Type(); t == data.FieldTypeString || t == data.FieldTypeNullableString {
-				continue
-			}
-
-			var err error
-			if frame, err = convertSQLValueColumnToFloat(frame, i); err != nil {
+	// every split frame is converted on its own
+	var result data.Frames
+	for _, frame := range frames {
+		if frameQm.Format == dataQueryFormatSeries && frameQm.timeIndex == -1 {
+			// aggregates without a time column are returned as numeric data
+			numeric, err := toNumericFrame(frame)
+			if err != nil {
 				errAppendDebug("convert value to float failed", err, interpolatedQuery)
 				return
 			}
+			result = append(result, numeric)
+			continue
 		}
 
-		tsSchema := frame.TimeSeriesSchema()
-		if tsSchema.Type == data.TimeSeriesTypeLong {
-			var err error
-			originalData := frame
-			frame, err = data.LongToWide(frame, qm.FillMissing)
+		if frameQm.Format == dataQueryFormatHeatmap {
+			heatmap, pivoted, err := toHeatmapFrame(frame, frameQm, run.cumulativeBuckets)
 			if err != nil {
-				errAppendDebug("failed to convert long to wide series when converting from dataframe", err, interpolatedQuery)
+				errAppendDebug("converting to heatmap failed", err, interpolatedQuery)
 				return
 			}
+			if pivoted {
+				customMeta.YMatchWithLabel = heatmapBucketLabel
+			}
+			frame = heatmap
+		}
+
+		if frameQm.Format == dataQueryFormatSeries {
+			// Make sure to name the time field 'Time' to be backward compatible with Grafana pre-v8.
+			frame.Fields[frameQm.timeIndex].Name = data.TimeSeriesTimeFieldName
+
+			for i := range frameQm.columnNames {
+				if i == frameQm.timeIndex || i == frameQm.metricIndex {
+					continue
+				}
+
+				if t := frame.Fields[i].Type(); t == data.FieldTypeString || t == data.FieldTypeNullableString {
+					continue
+				}
+
+				var err error
+				if frame, err = convertSQLValueColumnToFloat(frame, i); err != nil {
+					errAppendDebug("convert value to float failed", err, interpolatedQuery)
+					return
+				}
+			}
+
+			tsSchema := frame.TimeSeriesSchema()
+			if tsSchema.Type == data.TimeSeriesTypeLong {
+				var err error
+				frame, err = data.LongToWide(frame, frameQm.FillMissing)
+				if err != nil {
+					errAppendDebug("failed to convert long to wide series when converting from dataframe", err, interpolatedQuery)
+					return
+				}
 
-			// Before 8x, a special metric column was used to name time series. The LongToWide transforms that into a metric label on the value field.
-			// But that makes series name have both the value column name AND the metric name. So here we are removing the metric label here and moving it to the
-			// field name to get the same naming for the series as pre v8
-			if len(originalData.Fields) == 3 {
-				for _, field := range frame.Fields {
-					if len(field.Labels) == 1 { // 7x only supported one label
-						name, ok := field.Labels["metric"]
-						if ok {
+				// Before 8x, a special metric column was used to name time series. The LongToWide transforms that into a metric label on the value field.
+				// But that makes series name have both the value column name AND the metric name. So here we are removing the metric label here and moving it to the
+				// field name to get the same naming for the series as pre v8. Any other label columns stay labels.
+				if len(tsSchema.ValueIndices) == 1 {
+					for _, field := range frame.Fields {
+						if name, ok := field.Labels["metric"]; ok {
 							field.Name = name
-							field.Labels = nil
+							field.Labels = field.Labels.Copy()
+							delete(field.Labels, "metric")
+							if len(field.Labels) == 0 {
+								field.Labels = nil
+							}
 						}
 					}
 				}
 			}
-		}
-		if qm.FillMissing != nil {
-			// we align the start-time
-			startUnixTime := qm.TimeRange.From.Unix() / int64(qm.Interval.Seconds()) * int64(qm.Interval.Seconds())
-			alignedTimeRange := backend.TimeRange{
-				From: time.Unix(startUnixTime, 0),
-				To:   qm.TimeRange.To,
+			if frameQm.FillMissing != nil && frameQm.Interval > 0 {
+				// we align the start-time
+				alignedTimeRange := backend.TimeRange{
+					From: alignedStart(frameQm.TimeRange.From, frameQm.Interval),
+					To:   frameQm.TimeRange.To,
+				}
+
+				var err error
+				frame, err = sqlutil.ResampleWideFrame(frame, frameQm.FillMissing, alignedTimeRange, frameQm.Interval)
+				if err != nil {
+					logger.Error("Failed to resample dataframe", "err", err)
+					frame.AppendNotices(data.Notice{Text: "Failed to resample dataframe", Severity: data.NoticeSeverityWarning})
+				}
+			}
+			if frameQm.fillMode != "" {
+				if err := fillNullPoints(frame, frameQm.fillMode); err != nil {
+					errAppendDebug("filling missing points failed", err, interpolatedQuery)
+					return
+				}
+			}
+
+			if downsample == downsampleLTTB {
+				frame = lttbFrame(frame, int(query.MaxDataPoints))
 			}
 
+			if queryJson.LegendFormat != "" {
+				applyLegendFormat(frame, queryJson.LegendFormat)
+			}
+		}
+
+		if timeShift > 0 {
+			shiftTimeFields(frame, timeShift)
+		}
+
+		switch {
+		case frameQm.Format == dataQueryFormatHeatmap:
+			// the frame type depends on the shape of the result
+			result = append(result, frame)
+		case frameQm.Format == dataQueryFormatLogs:
 			var err error
-			frame, err = sqlutil.ResampleWideFrame(frame, qm.FillMissing, alignedTimeRange, qm.Interval)
+			if frame, err = convertToLogsFrame(frame, frameQm); err != nil {
+				errAppendDebug("convert to logs failed", err, interpolatedQuery)
+				return
+			}
+			result = append(result, frame)
+		case frameQm.Format == dataQueryFormatSeries && fromAlert:
+			result = append(result, toTimeSeriesMulti(frame)...)
+		case frameQm.Format == dataQueryFormatSeries && longSeries:
+			// converted after filling and downsampling, which work on wide frames
+			long, err := toTimeSeriesLong(frame)
 			if err != nil {
-				logger.Error("Failed to resample dataframe", "err", err)
-				frame.AppendNotices(data.Notice{Text: "Failed to resample dataframe", Severity: data.NoticeSeverityWarning})
+				errAppendDebug("failed to convert wide to long series", err, interpolatedQuery)
+				return
 			}
+			result = append(result, long)
+		case frameQm.Format == dataQueryFormatSeries:
+			setFrameType(frame, data.FrameTypeTimeSeriesWide)
+			result = append(result, frame)
+		default:
+			setFrameType(frame, data.FrameTypeTable)
+			result = append(result, frame)
 		}
 	}
 
-	queryResult.dataResponse.Frames = data.Frames{frame}
+	setCustomMeta(result, customMeta)
+	appendNotices(result, run.notices)
+	e.appendStaleNotice(result)
+	queryResult.dataResponse.Frames = result
 	ch <- queryResult
 }
 
+// queryRun is the result of running the query on one time range
+type queryRun struct {
+	// query is the query after interpolation, macros record settings such as fill in its JSON
+	query             backend.DataQuery
+	interpolatedQuery string
+	frame             *data.Frame
+	qm                *dataQueryModel
+	// explained is set when frame is the plan of the query instead of its result
+	explained bool
+	// cumulativeBuckets tells whether the le buckets of a heatmap hold cumulative counts, see histogramQuery
+	cumulativeBuckets bool
+	// snapshot is the snapshot the query ran on, empty unless the database is a directory
+	snapshot string
+	// notices are added to every frame of the result
+	notices []data.Notice
+}
+
+// queryStageError is the error of a stage of runQuery with the query as far as it was interpolated
+type queryStageError struct {
+	stage string
+	query string
+	err   error
+}
+
+func (e *queryStageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.stage, e.err)
+}
+
+func (e *queryStageError) Unwrap() error {
+	return e.err
+}
+
+// runQuery interpolates the query for its time range, runs it and reads the rows into a frame
+func (e *DataSourceHandler) runQuery(queryContext context.Context, query backend.DataQuery, queryJson QueryJson) (*queryRun, error) {
+	logger := e.log.FromContext(queryContext)
+	timeRange := query.TimeRange
+
+	fail := func(stage string, err error, interpolatedQuery string) (*queryRun, error) {
+		return nil, &queryStageError{stage: stage, query: interpolatedQuery, err: err}
+	}
+
+	db, snapshot, err := e.snapshotDatabase(querySnapshot(queryJson))
+	if err != nil {
+		return fail("selecting the snapshot failed", err, queryJson.RawSql)
+	}
+	if snapshot != "" {
+		// for $__snapshot()
+		if err := setQuerySnapshot(&query, snapshot); err != nil {
+			return fail("selecting the snapshot failed", err, queryJson.RawSql)
+		}
+	}
+
+	// global substitutions
+	interpolatedQuery := Interpolate(query, timeRange, e.dsInfo.JsonData.TimeInterval, queryJson.RawSql)
+
+	// data source specific substitutions
+	interpolatedQuery, err = e.macroEngine.Interpolate(&query, timeRange, interpolatedQuery)
+	if err != nil {
+		return fail("interpolation failed", e.TransformQueryError(logger, err), interpolatedQuery)
+	}
+	if e.readOnlyQueries() {
+		if err := checkReadOnlyQuery(interpolatedQuery); err != nil {
+			return fail("checking the query failed", err, interpolatedQuery)
+		}
+	}
+
+	// the result columns are needed to skip ad-hoc filters on missing columns, to find geometry columns, to
+	// downsample and to find histograms
+	var columns []describedColumn
+	heatmap := queryJson.Format == string(dataQueryFormatHeatmap)
+	if len(queryJson.AdhocFilters) > 0 || queryJson.Downsample != "" || heatmap || e.generationSpatialLoaded(queryContext, db) {
+		if columns, err = e.describeQuery(queryContext, db, interpolatedQuery); err != nil {
+			if len(queryJson.AdhocFilters) > 0 {
+				// without the columns no filter would apply and the query would run unfiltered
+				return fail("describing the query for the ad-hoc filters failed", e.TransformQueryError(logger, err), interpolatedQuery)
+			}
+			// the query itself reports a proper error below
+			logger.Debug("Failed to describe query", "err", err)
+		}
+	}
+
+	var notices []data.Notice
+	if len(queryJson.AdhocFilters) > 0 {
+		var skipped []string
+		if interpolatedQuery, skipped, err = applyAdhocFilters(interpolatedQuery, queryJson.AdhocFilters, columns); err != nil {
+			return fail("applying ad-hoc filters failed", err, interpolatedQuery)
+		}
+		if len(skipped) > 0 {
+			notices = append(notices, skippedAdhocFiltersNotice(skipped))
+		}
+	}
+
+	downsample := strings.ToLower(queryJson.Downsample)
+	if downsample != "" {
+		if interpolatedQuery, err = downsampleQuery(interpolatedQuery, downsample, e.timeColumnNames, columns, timeRange, query.MaxDataPoints); err != nil {
+			return fail("downsampling failed", err, interpolatedQuery)
+		}
+	}
+
+	// histograms are unnested into buckets, unlike the le buckets of Prometheus their counts are not cumulative
+	run := &queryRun{cumulativeBuckets: true, snapshot: snapshot, notices: notices}
+	if heatmap {
+		var unnested bool
+		interpolatedQuery, unnested = histogramQuery(interpolatedQuery, columns)
+		run.cumulativeBuckets = !unnested
+	}
+
+	if explain := strings.ToLower(queryJson.Explain); explain != "" {
+		frame, err := e.explainQuery(queryContext, db, explain, interpolatedQuery)
+		if err != nil {
+			return fail("explain failed", e.TransformQueryError(logger, err), interpolatedQuery)
+		}
+		return &queryRun{interpolatedQuery: interpolatedQuery, frame: frame, explained: true}, nil
+	}
+
+	geometryColumns := filterGeometryColumns(columns)
+	interpolatedQuery = wrapGeometryQuery(interpolatedQuery, geometryColumns, strings.ToLower(e.dsInfo.JsonData.GeometryFormat))
+
+	rows, err := db.QueryContext(queryContext, interpolatedQuery)
+	if err != nil {
+		return fail("db query error", e.TransformQueryError(logger, err), interpolatedQuery)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			logger.Warn("Failed to close rows", "err", err)
+		}
+	}()
+
+	qm, err := e.newProcessCfg(query, queryContext, rows, interpolatedQuery)
+	if err != nil {
+		return fail("failed to get configurations", err, interpolatedQuery)
+	}
+
+	// Convert row.Rows to dataframe
+	converters := e.queryResultTransformer.GetConverterList()
+	frame, err := sqlutil.FrameFromRows(rows, e.rowLimit, converters...)
+	if err != nil {
+		return fail("convert frame from rows error", err, interpolatedQuery)
+	}
+
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+
+	frame.Meta.ExecutedQueryString = interpolatedQuery
+
+	if len(geometryColumns) > 0 {
+		if err := convertGeometryFields(frame, qm, geometryColumns); err != nil {
+			return fail("converting geometry columns failed", err, interpolatedQuery)
+		}
+	}
+
+	run.query, run.interpolatedQuery, run.frame, run.qm = query, interpolatedQuery, frame, qm
+	return run, nil
+}
+
 // CheckHealth pings the connected SQL database
 func (e *DataSourceHandler) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
 	if _, err := os.Stat(e.dsInfo.Database); err != nil {
@@ -458,7 +924,40 @@ func (e *DataSourceHandler) CheckHealth(ctx context.Context, req *backend.CheckH
 	//	return &backend.CheckHealthResult{Status: backend.HealthStatusError, Message: dsHandler.TransformQueryError(s.logger, err).Error()}, nil
 	// }
 
-	return &backend.CheckHealthResult{Status: backend.HealthStatusOk, Message: "Database Connection OK"}, nil
+	if missing, err := e.missingExtensions(ctx); err != nil {
+		return &backend.CheckHealthResult{Status: backend.HealthStatusError, Message: e.TransformQueryError(e.log, err).Error()}, nil
+	} else if len(missing) > 0 {
+		return &backend.CheckHealthResult{Status: backend.HealthStatusError, Message: fmt.Sprintf("required extensions not loaded: %s", strings.Join(missing, ", "))}, nil
+	}
+
+	message := "Database Connection OK"
+	if loaded := e.loaded.Load(); loaded != nil {
+		if loaded.mode == loadModeMemory {
+			message += fmt.Sprintf(", loaded %s into memory", formatByteSize(loaded.size))
+		} else if loaded.fallback != "" {
+			message += fmt.Sprintf(", reading the file: %s", loaded.fallback)
+		}
+	}
+
+	e.snapshotsMu.RLock()
+	if len(e.snapshots) > 0 {
+		message += fmt.Sprintf(", serving snapshot %s (%d open)", e.snapshots[0].name, len(e.snapshots))
+	}
+	e.snapshotsMu.RUnlock()
+
+	if warmup := e.warmup.Load(); warmup != nil {
+		if warmup.err != nil {
+			return &backend.CheckHealthResult{Status: backend.HealthStatusError, Message: fmt.Sprintf("%s after %s at %s", warmup.err, warmup.duration, warmup.finished.Format(time.RFC3339))}, nil
+		}
+		message += fmt.Sprintf(", warm-up took %s at %s", warmup.duration, warmup.finished.Format(time.RFC3339))
+	}
+
+	// the previous generation still answers the queries
+	if stale := e.loadFailures.staleReason(); stale != "" {
+		message += fmt.Sprintf(". Warning: %s", stale)
+	}
+
+	return &backend.CheckHealthResult{Status: backend.HealthStatusOk, Message: message}, nil
 }
 
 // Interpolate provides global macros/substitutions for all sql datasources.
@@ -500,19 +999,9 @@ func (e *DataSourceHandler) newProcessCfg(query backend.DataQuery, queryContext
 		return nil, err
 	}
 
-	if queryJson.Fill {
-		qm.FillMissing = &data.FillMissing{}
-		qm.Interval = time.Duration(queryJson.FillInterval * float64(time.Second))
-		switch strings.ToLower(queryJson.FillMode) {
-		case "null":
-			qm.FillMissing.Mode = data.FillModeNull
-		case "previous":
-			qm.FillMissing.Mode = data.FillModePrevious
-		case "value":
-			qm.FillMissing.Mode = data.FillModeValue
-			qm.FillMissing.Value = queryJson.FillValue
-		default:
-		}
+	// the fill settings are sent with the query or set by the fill argument of $__timeGroup
+	if err := qm.setupFill(queryJson, query.Interval); err != nil {
+		return nil, err
 	}
 
 	qm.TimeRange.From = query.TimeRange.From.UTC()
@@ -523,6 +1012,10 @@ func (e *DataSourceHandler) newProcessCfg(query backend.DataQuery, queryContext
 		qm.Format = dataQueryFormatSeries
 	case "table":
 		qm.Format = dataQueryFormatTable
+	case "logs":
+		qm.Format = dataQueryFormatLogs
+	case "heatmap":
+		qm.Format = dataQueryFormatHeatmap
 	default:
 		panic(fmt.Sprintf("Unrecognized query model format: %q", queryJson.Format))
 	}
@@ -559,6 +1052,44 @@ func (e *DataSourceHandler) newProcessCfg(query backend.DataQuery, queryContext
 	return qm, nil
 }
 
+type describedColumn struct {
+	name       string
+	columnType string
+}
+
+// describeQuery binds the query without running it and returns the names and types of its result columns.
+func (e *DataSourceHandler) describeQuery(ctx context.Context, db *sql.DB, query string) ([]describedColumn, error) {
+	rows, err := db.QueryContext(ctx, "DESCRIBE "+strings.TrimRight(strings.TrimSpace(query), ";"))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			e.log.Warn("Failed to close rows", "err", err)
+		}
+	}()
+
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []describedColumn
+	for rows.Next() {
+		values := make([]any, len(columnNames))
+		for i := range values {
+			values[i] = new(any)
+		}
+		if err := rows.Scan(values...); err != nil {
+			return nil, err
+		}
+		name, _ := (*values[0].(*any)).(string)
+		columnType, _ := (*values[1].(*any)).(string)
+		columns = append(columns, describedColumn{name: name, columnType: columnType})
+	}
+	return columns, rows.Err()
+}
+
 // dataQueryFormat is the type of query.
 type dataQueryFormat string
 
@@ -567,6 +1098,10 @@ const (
 	dataQueryFormatTable dataQueryFormat = "table"
 	// dataQueryFormatSeries identifies a time series query.
 	dataQueryFormatSeries dataQueryFormat = "time_series"
+	// dataQueryFormatLogs identifies a logs query.
+	dataQueryFormatLogs dataQueryFormat = "logs"
+	// dataQueryFormatHeatmap identifies a heatmap query.
+	dataQueryFormatHeatmap dataQueryFormat = "heatmap"
 )
 
 type dataQueryModel struct {
@@ -581,6 +1116,7 @@ type dataQueryModel struct {
 	timeEndIndex      int
 	metricIndex       int
 	metricPrefix      bool
+	fillMode          string // fillModeLinear or fillModeZeroAfterLast, on top of FillMissing
 	queryContext      context.Context
 }
 
@@ -682,6 +1218,8 @@ func SetupFillmode(query *backend.DataQuery, interval time.Duration, fillmode st
 		rawQueryProp["fillMode"] = "null"
 	case "previous":
 		rawQueryProp["fillMode"] = "previous"
+	case fillModeLinear, fillModeZeroAfterLast:
+		rawQueryProp["fillMode"] = fillmode
 	default:
 		rawQueryProp["fillMode"] = "value"
 		floatVal, err := strconv.ParseFloat(fillmode, 64)
@@ -703,23 +1241,6 @@ func NewSQLMacroEngineBase() *SQLMacroEngineBase {
 	return &SQLMacroEngineBase{}
 }
 
-func (m *SQLMacroEngineBase) ReplaceAllStringSubmatchFunc(re *regexp.Regexp, str string, repl func([]string) string) string {
-	result := ""
-	lastIndex := 0
-
-	for _, v := range re.FindAllStringSubmatchIndex(str, -1) {
-		groups := []string{}
-		for i := 0; i < len(v); i += 2 {
-			groups = append(groups, str[v[i]:v[i+1]])
-		}
-
-		result += str[lastIndex:v[0]] + repl(groups)
-		lastIndex = v[1]
-	}
-
-	return result + str[lastIndex:]
-}
-
 // epochPrecisionToMS converts epoch precision to millisecond, if needed.
 // Only seconds to milliseconds supported right now
 func epochPrecisionToMS(value float64) float64 {
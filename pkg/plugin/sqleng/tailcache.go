@@ -0,0 +1,222 @@
+package sqleng
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// maxTailCacheEntries bounds the number of queries the tail cache holds
+const maxTailCacheEntries = 256
+
+// tailCacheTTL is how long an entry is used after it was last stored, dashboards no longer watched are forgotten
+const tailCacheTTL = 15 * time.Minute
+
+// tailCache holds the bucketed results of time series queries by fingerprint, so that a refresh only reads the
+// buckets after the last complete one. See DataSourceHandler.runIncremental.
+type tailCache struct {
+	mu      sync.Mutex
+	entries map[string]*tailCacheEntry
+}
+
+type tailCacheEntry struct {
+	// frame holds the rows from the start of the range up to and including lastBucket, with converted times
+	frame      *data.Frame
+	from       time.Time
+	lastBucket time.Time
+	stored     time.Time
+}
+
+func newTailCache() *tailCache {
+	return &tailCache{entries: map[string]*tailCacheEntry{}}
+}
+
+func (c *tailCache) get(key string, now time.Time) *tailCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[key]
+	if entry != nil && now.Sub(entry.stored) > tailCacheTTL {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func (c *tailCache) set(key string, entry *tailCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for cached, e := range c.entries {
+		if entry.stored.Sub(e.stored) > tailCacheTTL {
+			delete(c.entries, cached)
+		}
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxTailCacheEntries {
+		// evict any entry, the dashboards being watched fill it again
+		for evicted := range c.entries {
+			delete(c.entries, evicted)
+			break
+		}
+	}
+	c.entries[key] = entry
+}
+
+// clear drops every entry, a new database generation may have changed the buckets
+func (c *tailCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*tailCacheEntry{}
+}
+
+// isIncrementalQuery tells whether the query buckets a time series with $__timeGroup, the results the tail cache
+// can extend. Downsampled results depend on the whole range and are not cached.
+func isIncrementalQuery(queryJson QueryJson) bool {
+	if queryJson.Format != string(dataQueryFormatSeries) || queryJson.Explain != "" || queryJson.Downsample != "" {
+		return false
+	}
+	// the bucket containing the start of the range is queried again, its width must be known
+	if alignment, ok := timeGroupAlignment(queryJson.RawSql, 0); !ok || alignment == 0 {
+		return false
+	}
+	for _, call := range FindMacroCalls(queryJson.RawSql) {
+		if call.Name == "__timeGroup" || call.Name == "__timeGroupAlias" {
+			return true
+		}
+	}
+	return false
+}
+
+// tailCacheKey is the fingerprint of everything but the time range of the query
+func tailCacheKey(query backend.DataQuery, queryJson QueryJson) string {
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(hash, "%s\x00%s\x00%d\x00", queryJson.RawSql, query.JSON, query.Interval)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// runIncremental runs time series queries using $__timeGroup through the tail cache. On a hit only the range from
+// the last cached bucket on is queried, that bucket may have been incomplete. Cached buckets before the start of
+// the range are dropped. When the range starts inside a bucket and the cached one started elsewhere, that bucket
+// only holds the rows from the start on and is queried again as well, so that the result is the one of a query
+// without the cache.
+func (e *DataSourceHandler) runIncremental(ctx context.Context, query backend.DataQuery, queryJson QueryJson) (*queryRun, error) {
+	if e.tailCache == nil || !isIncrementalQuery(queryJson) {
+		return e.runChunks(ctx, query, queryJson)
+	}
+	key := tailCacheKey(query, queryJson)
+	timeRange := query.TimeRange
+
+	entry := e.tailCache.get(key, time.Now())
+	if entry == nil || timeRange.From.Before(entry.from) || entry.lastBucket.Before(timeRange.From) || timeRange.To.Before(entry.lastBucket) {
+		run, err := e.runChunks(ctx, query, queryJson)
+		if err != nil {
+			return nil, err
+		}
+		e.cacheTail(key, timeRange.From, run)
+		return run, nil
+	}
+
+	tail := query
+	tail.TimeRange.From = entry.lastBucket
+	run, err := e.runQuery(ctx, tail, queryJson)
+	if err != nil {
+		return nil, err
+	}
+	if err := convertSQLTimeColumnsToEpochMS(run.frame, run.qm); err != nil {
+		return nil, &queryStageError{stage: "converting time columns failed", query: run.interpolatedQuery, err: err}
+	}
+
+	frame := run.frame.EmptyCopy()
+	frame.Meta = run.frame.Meta
+	executed := []string{run.interpolatedQuery}
+	width, _ := timeGroupAlignment(queryJson.RawSql, 0)
+	// the cached bucket containing the start of the range was read from the same start, or is queried again
+	headStart := alignedStart(timeRange.From, width).In(timeRange.From.Location())
+	cachedFrom := headStart
+	if !headStart.Equal(timeRange.From) && !timeRange.From.Equal(entry.from) {
+		cachedFrom = headStart.Add(width).In(timeRange.From.Location())
+		head := query
+		head.TimeRange.To = cachedFrom
+		headRun, err := e.runQuery(ctx, head, queryJson)
+		if err != nil {
+			return nil, err
+		}
+		if err := convertSQLTimeColumnsToEpochMS(headRun.frame, headRun.qm); err != nil {
+			return nil, &queryStageError{stage: "converting time columns failed", query: headRun.interpolatedQuery, err: err}
+		}
+		if err := appendBuckets(frame, headRun.frame, run.qm.timeIndex, headStart, cachedFrom); err != nil {
+			return nil, &queryStageError{stage: "extending the cached buckets failed", query: headRun.interpolatedQuery, err: err}
+		}
+		executed = append([]string{headRun.interpolatedQuery}, executed...)
+	}
+	if err := appendBuckets(frame, entry.frame, run.qm.timeIndex, cachedFrom, entry.lastBucket); err != nil {
+		// the columns changed, the cached buckets are of no use
+		return e.runChunks(ctx, query, queryJson)
+	}
+	if err := appendBuckets(frame, run.frame, run.qm.timeIndex, entry.lastBucket, time.Time{}); err != nil {
+		return nil, &queryStageError{stage: "extending the cached buckets failed", query: run.interpolatedQuery, err: err}
+	}
+
+	run.interpolatedQuery = strings.Join(executed, ";\n")
+	run.qm.InterpolatedQuery = run.interpolatedQuery
+	frame.Meta.ExecutedQueryString = run.interpolatedQuery
+	run.frame = frame
+	run.query.TimeRange = timeRange
+	run.qm.TimeRange = backend.TimeRange{From: timeRange.From.UTC(), To: timeRange.To.UTC()}
+	e.cacheTail(key, timeRange.From, run)
+	return run, nil
+}
+
+// cacheTail stores a copy of the result, the frame of the run is changed further by executeQuery
+func (e *DataSourceHandler) cacheTail(key string, from time.Time, run *queryRun) {
+	if run.qm.timeIndex == -1 || convertSQLTimeColumnsToEpochMS(run.frame, run.qm) != nil {
+		return
+	}
+	var lastBucket time.Time
+	for row := 0; row < run.frame.Rows(); row++ {
+		if t, ok := run.frame.Fields[run.qm.timeIndex].ConcreteAt(row); ok && t.(time.Time).After(lastBucket) {
+			lastBucket = t.(time.Time)
+		}
+	}
+	if lastBucket.IsZero() {
+		return
+	}
+
+	frame := run.frame.EmptyCopy()
+	if err := appendBuckets(frame, run.frame, run.qm.timeIndex, time.Time{}, time.Time{}); err != nil {
+		return
+	}
+	e.tailCache.set(key, &tailCacheEntry{frame: frame, from: from, lastBucket: lastBucket, stored: time.Now()})
+}
+
+// appendBuckets appends copies of the rows of source with a time from from and before before to frame. A zero
+// time does not bound the rows.
+func appendBuckets(frame *data.Frame, source *data.Frame, timeIndex int, from time.Time, before time.Time) error {
+	if len(source.Fields) != len(frame.Fields) {
+		return fmt.Errorf("the results have different columns")
+	}
+	for i, field := range source.Fields {
+		if field.Type() != frame.Fields[i].Type() {
+			return fmt.Errorf("column %q has different types in the results", field.Name)
+		}
+	}
+	for row := 0; row < source.Rows(); row++ {
+		t, ok := source.Fields[timeIndex].ConcreteAt(row)
+		switch {
+		case !ok && (!from.IsZero() || !before.IsZero()):
+			// rows without a time are not part of a range
+			continue
+		case ok && (t.(time.Time).Before(from) || (!before.IsZero() && !t.(time.Time).Before(before))):
+			continue
+		}
+		for i, field := range source.Fields {
+			frame.Fields[i].Append(field.CopyAt(row))
+		}
+	}
+	return nil
+}
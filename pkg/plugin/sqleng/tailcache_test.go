@@ -0,0 +1,131 @@
+package sqleng
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+// tailTestMacroEngine expands $__timeGroupAlias to hourly buckets and $__timeFilter
+type tailTestMacroEngine struct {
+	SQLMacroEngineBase
+}
+
+func (m *tailTestMacroEngine) Interpolate(_ *backend.DataQuery, timeRange backend.TimeRange, sql string) (string, error) {
+	return m.ReplaceMacros(sql, func(call MacroCall) (string, error) {
+		if call.Name == "__timeFilter" {
+			return fmt.Sprintf("epoch(%s) BETWEEN %d AND %d", call.Args[0], timeRange.From.Unix(), timeRange.To.Unix()), nil
+		}
+		return fmt.Sprintf("time_bucket(INTERVAL 1 hour, %s) AS time", call.Args[0]), nil
+	})
+}
+
+func TestTailCache(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	const rawSQL = "SELECT $__timeGroupAlias(time, 1h), count(*) AS value FROM metrics WHERE $__timeFilter(time) GROUP BY 1 ORDER BY 1"
+
+	setup := func(t *testing.T, appendOnly bool) (*DataSourceHandler, func(minutes ...int)) {
+		csv := filepath.Join(t.TempDir(), "metrics.csv")
+		appendRows := func(minutes ...int) {
+			f, err := os.OpenFile(csv, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+			require.NoError(t, err)
+			defer f.Close()
+			for _, minute := range minutes {
+				_, err := fmt.Fprintf(f, "%s,1\n", start.Add(time.Duration(minute)*time.Minute).Format("2006-01-02 15:04:05"))
+				require.NoError(t, err)
+			}
+		}
+		var minutes []int
+		for minute := 0; minute < 180; minute += 10 {
+			minutes = append(minutes, minute)
+		}
+		appendRows(minutes...)
+
+		handler := newTestHandler(t, JsonData{IncrementalQueries: true, AppendOnly: appendOnly, ReloadAutomatically: true},
+			"CREATE VIEW metrics AS SELECT * FROM read_csv('"+csv+"', header = false, columns = {'time': 'TIMESTAMP', 'value': 'DOUBLE'})",
+		)
+		handler.macroEngine = &tailTestMacroEngine{}
+		return handler, appendRows
+	}
+
+	query := func(t *testing.T, handler *DataSourceHandler, from, to time.Duration) (map[time.Time]float64, string) {
+		resp := queryData(t, handler, backend.DataQuery{
+			Interval:  time.Hour,
+			TimeRange: backend.TimeRange{From: start.Add(from), To: start.Add(to)},
+			JSON:      []byte(`{"rawSql": "` + rawSQL + `", "format": "time_series"}`),
+		})
+		require.NoError(t, resp.Error)
+		frame := resp.Frames[0]
+		counts := map[time.Time]float64{}
+		for i := 0; i < frame.Rows(); i++ {
+			counts[*frame.Fields[0].At(i).(*time.Time)] = *frame.Fields[1].At(i).(*float64)
+		}
+		return counts, frame.Meta.ExecutedQueryString
+	}
+
+	t.Run("Should only query the buckets after the last complete one", func(t *testing.T) {
+		handler, appendRows := setup(t, false)
+		counts, _ := query(t, handler, 0, 3*time.Hour)
+		require.Equal(t, map[time.Time]float64{start: 6, start.Add(time.Hour): 6, start.Add(2 * time.Hour): 6}, counts)
+
+		// the row at 01:30 is not read again, the bucket at 02:00 and later ones are, and the bucket at 00:00 is read
+		// from 00:30 on like without the cache
+		appendRows(90, 180, 190)
+		counts, executed := query(t, handler, 30*time.Minute, 4*time.Hour)
+		require.Equal(t, map[time.Time]float64{start: 3, start.Add(time.Hour): 6, start.Add(2 * time.Hour): 6, start.Add(3 * time.Hour): 2}, counts)
+		require.Len(t, strings.Split(executed, ";\n"), 2)
+		require.True(t, strings.Contains(executed, fmt.Sprint(start.Add(2*time.Hour).Unix())), executed)
+
+		// a cold query returns the same buckets, but for the late row at 01:30
+		cold, appendCold := setup(t, false)
+		appendCold(180, 190)
+		uncached, _ := query(t, cold, 30*time.Minute, 4*time.Hour)
+		require.Equal(t, uncached, counts)
+
+		// refreshing from the same start keeps the cached partial bucket at 00:00 and only reads the tail
+		refreshed, executed := query(t, handler, 30*time.Minute, 4*time.Hour)
+		require.Equal(t, counts, refreshed)
+		require.Len(t, strings.Split(executed, ";\n"), 1)
+	})
+
+	t.Run("Should forget the entries after the TTL", func(t *testing.T) {
+		cache := newTailCache()
+		now := time.Now()
+		cache.set("old", &tailCacheEntry{stored: now.Add(-tailCacheTTL - time.Minute)})
+		cache.set("new", &tailCacheEntry{stored: now})
+		require.Nil(t, cache.get("old", now))
+		require.NotNil(t, cache.get("new", now))
+		require.Nil(t, cache.get("new", now.Add(tailCacheTTL+time.Minute)))
+	})
+
+	for _, appendOnly := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Should drop the cache on a new generation unless append-only (%v)", appendOnly), func(t *testing.T) {
+			handler, appendRows := setup(t, appendOnly)
+			query(t, handler, 0, 3*time.Hour)
+
+			appendRows(90)
+			later := time.Now().Add(time.Minute)
+			require.NoError(t, os.Chtimes(handler.dsInfo.Database, later, later))
+			counts, _ := query(t, handler, 0, 3*time.Hour)
+			if appendOnly {
+				require.Equal(t, 6.0, counts[start.Add(time.Hour)])
+			} else {
+				require.Equal(t, 7.0, counts[start.Add(time.Hour)])
+			}
+		})
+	}
+
+	t.Run("Should only cache time series grouped by time", func(t *testing.T) {
+		require.True(t, isIncrementalQuery(QueryJson{Format: "time_series", RawSql: rawSQL}))
+		require.False(t, isIncrementalQuery(QueryJson{Format: "table", RawSql: rawSQL}))
+		require.False(t, isIncrementalQuery(QueryJson{Format: "time_series", RawSql: rawSQL, Downsample: "lttb"}))
+		require.False(t, isIncrementalQuery(QueryJson{Format: "time_series", RawSql: "SELECT '$__timeGroup(time, 1h)' AS time"}))
+		require.False(t, isIncrementalQuery(QueryJson{Format: "time_series", RawSql: "SELECT $__timeGroup(time, 1M) AS time"}))
+	})
+}
@@ -0,0 +1,48 @@
+package sqleng
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// ParseTimeShift parses a shift such as '7d' or 1h. The shift points back in time and must be positive.
+func ParseTimeShift(shift string) (time.Duration, error) {
+	shift = strings.Trim(strings.TrimSpace(shift), `'`)
+	duration, err := gtime.ParseDuration(shift)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing time shift %q", shift)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("time shift %q must be positive", shift)
+	}
+	return duration, nil
+}
+
+// shiftTimeRange moves the time range back by shift
+func shiftTimeRange(timeRange backend.TimeRange, shift time.Duration) backend.TimeRange {
+	return backend.TimeRange{From: timeRange.From.Add(-shift), To: timeRange.To.Add(-shift)}
+}
+
+// shiftTimeFields moves every time of the frame forward by shift, back onto the range of the panel
+func shiftTimeFields(frame *data.Frame, shift time.Duration) {
+	for _, field := range frame.Fields {
+		switch field.Type() {
+		case data.FieldTypeTime:
+			for i := 0; i < field.Len(); i++ {
+				field.Set(i, field.At(i).(time.Time).Add(shift))
+			}
+		case data.FieldTypeNullableTime:
+			for i := 0; i < field.Len(); i++ {
+				if t := field.At(i).(*time.Time); t != nil {
+					shifted := t.Add(shift)
+					field.Set(i, &shifted)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package sqleng
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeShift(t *testing.T) {
+	handler := newTestHandler(t, JsonData{},
+		"CREATE TABLE metrics AS SELECT TIMESTAMP '2024-01-01' + to_days(CAST(i AS INTEGER)) AS time, i AS value FROM range(0, 14) t(i)",
+	)
+	from := time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)
+
+	query := func(t *testing.T, queryJSON string) backend.DataResponse {
+		return queryData(t, handler, backend.DataQuery{
+			TimeRange: backend.TimeRange{From: from, To: from.Add(48 * time.Hour)},
+			JSON:      []byte(queryJSON),
+		})
+	}
+
+	t.Run("Should read last week and move it onto the current range", func(t *testing.T) {
+		resp := query(t, `{"rawSql": "SELECT time, value FROM metrics WHERE epoch(time) BETWEEN $__unixEpochFrom() AND $__unixEpochTo() ORDER BY time", "format": "time_series", "timeShift": "7d"}`)
+		require.NoError(t, resp.Error)
+		frame := resp.Frames[0]
+		require.Equal(t, 3, frame.Rows())
+		require.Equal(t, from, *frame.Fields[0].At(0).(*time.Time))
+		require.Equal(t, 0.0, *frame.Fields[1].At(0).(*float64))
+		require.Equal(t, frameCustomMeta{TimeShift: "7d"}, frame.Meta.Custom)
+		require.Contains(t, frame.Meta.ExecutedQueryString, "1704067200")
+	})
+
+	t.Run("Should record the shift on empty results", func(t *testing.T) {
+		resp := query(t, `{"rawSql": "SELECT time, value FROM metrics WHERE epoch(time) BETWEEN $__unixEpochFrom() AND $__unixEpochTo()", "format": "table", "timeShift": "'365d'"}`)
+		require.NoError(t, resp.Error)
+		require.Equal(t, 0, resp.Frames[0].Rows())
+		require.Equal(t, frameCustomMeta{TimeShift: "365d"}, resp.Frames[0].Meta.Custom)
+	})
+
+	t.Run("Should reject invalid shifts", func(t *testing.T) {
+		resp := query(t, `{"rawSql": "SELECT 1", "format": "table", "timeShift": "-7d"}`)
+		require.ErrorContains(t, resp.Error, "invalid time shift")
+	})
+
+	t.Run("Should shift nullable times", func(t *testing.T) {
+		ts := from
+		frame := data.NewFrame("", data.NewField("time", nil, []*time.Time{&ts, nil}))
+		shiftTimeFields(frame, time.Hour)
+		require.Equal(t, from.Add(time.Hour), *frame.Fields[0].At(0).(*time.Time))
+		require.Nil(t, frame.Fields[0].At(1))
+	})
+}
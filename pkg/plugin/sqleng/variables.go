@@ -0,0 +1,90 @@
+package sqleng
+
+import (
+	"context"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	variableTextField  = "__text"
+	variableValueField = "__value"
+)
+
+// handleVariableQuery runs dashboard variable queries. They go through the regular SQL path, so macros and the
+// dashboard time range apply, and the result is reduced to de-duplicated __text/__value pairs.
+func (e *DataSourceHandler) handleVariableQuery(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	resp, err := e.handleSQLQueryWithFormat(ctx, req, dataQueryFormatTable)
+	if err != nil {
+		return nil, err
+	}
+
+	for refID, res := range resp.Responses {
+		if res.Error != nil || len(res.Frames) == 0 {
+			continue
+		}
+		res.Frames = data.Frames{toVariableFrame(res.Frames[0])}
+		resp.Responses[refID] = res
+	}
+	return resp, nil
+}
+
+// toVariableFrame picks the __text and __value columns if present. Otherwise the first column is used for both,
+// or the first two columns as text and value.
+func toVariableFrame(frame *data.Frame) *data.Frame {
+	textIndex, valueIndex := -1, -1
+	for i, field := range frame.Fields {
+		switch field.Name {
+		case variableTextField:
+			textIndex = i
+		case variableValueField:
+			valueIndex = i
+		}
+	}
+
+	switch {
+	case textIndex == -1 && valueIndex == -1 && len(frame.Fields) >= 2:
+		textIndex, valueIndex = 0, 1
+	case textIndex == -1 && valueIndex == -1 && len(frame.Fields) == 1:
+		textIndex, valueIndex = 0, 0
+	case textIndex == -1:
+		textIndex = valueIndex
+	case valueIndex == -1:
+		valueIndex = textIndex
+	}
+
+	text := data.NewFieldFromFieldType(data.FieldTypeString, 0)
+	text.Name = variableTextField
+	value := data.NewFieldFromFieldType(data.FieldTypeString, 0)
+	value.Name = variableValueField
+
+	if textIndex != -1 {
+		seen := make(map[[2]string]bool)
+		for i := 0; i < frame.Rows(); i++ {
+			t, textOk := frame.Fields[textIndex].ConcreteAt(i)
+			v, valueOk := frame.Fields[valueIndex].ConcreteAt(i)
+			if !textOk && !valueOk {
+				continue
+			}
+			if !textOk {
+				t = v
+			}
+			if !valueOk {
+				v = t
+			}
+
+			pair := [2]string{toString(t), toString(v)}
+			if seen[pair] {
+				continue
+			}
+			seen[pair] = true
+			text.Append(pair[0])
+			value.Append(pair[1])
+		}
+	}
+
+	variableFrame := data.NewFrame(frame.Name, text, value)
+	variableFrame.Meta = frame.Meta
+	return variableFrame
+}
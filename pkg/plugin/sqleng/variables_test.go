@@ -0,0 +1,73 @@
+package sqleng
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVariableQuery(t *testing.T) {
+	t.Run("Should pick variable columns", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			frame  *data.Frame
+			texts  []string
+			values []string
+		}{
+			{
+				"__text and __value",
+				data.NewFrame("", data.NewField("__value", nil, []int64{1, 2, 1}), data.NewField("other", nil, []string{"x", "y", "z"}), data.NewField("__text", nil, []string{"a", "b", "a"})),
+				[]string{"a", "b"}, []string{"1", "2"},
+			},
+			{
+				"single column",
+				data.NewFrame("", data.NewField("host", nil, []*string{Pointer("a"), nil, Pointer("b"), Pointer("a")})),
+				[]string{"a", "b"}, []string{"a", "b"},
+			},
+			{
+				"first two columns",
+				data.NewFrame("", data.NewField("name", nil, []string{"Berlin", "Paris"}), data.NewField("id", nil, []int32{1, 2}), data.NewField("extra", nil, []int32{3, 4})),
+				[]string{"Berlin", "Paris"}, []string{"1", "2"},
+			},
+			{
+				"only __value",
+				data.NewFrame("", data.NewField("x", nil, []string{"ignored"}), data.NewField("__value", nil, []string{"v"})),
+				[]string{"v"}, []string{"v"},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				frame := toVariableFrame(tt.frame)
+				require.Equal(t, []string{"__text", "__value"}, fieldNames(frame))
+				var texts, values []string
+				for i := 0; i < frame.Rows(); i++ {
+					texts = append(texts, frame.Fields[0].At(i).(string))
+					values = append(values, frame.Fields[1].At(i).(string))
+				}
+				require.Equal(t, tt.texts, texts)
+				require.Equal(t, tt.values, values)
+			})
+		}
+	})
+
+	t.Run("Should run variable queries through the query type mux", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{},
+			"CREATE TABLE hosts (name VARCHAR, seen TIMESTAMP)",
+			"INSERT INTO hosts VALUES ('b', '2024-01-01 12:00:00'), ('a', '2024-01-01 13:00:00'), ('b', '2024-01-01 14:00:00'), ('c', '2023-01-01 00:00:00')",
+		)
+		res := queryData(t, handler, backend.DataQuery{
+			RefID:     "host",
+			QueryType: queryTypeVariable,
+			TimeRange: backend.TimeRange{From: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+			JSON:      []byte(`{"rawSql": "SELECT name FROM hosts WHERE seen > '2024-01-01' ORDER BY name", "format": "time_series"}`),
+		})
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+		require.Equal(t, 2, res.Frames[0].Rows())
+		require.Equal(t, "a", res.Frames[0].Fields[0].At(0))
+		require.Equal(t, "b", res.Frames[0].Fields[1].At(1))
+	})
+}
@@ -0,0 +1,87 @@
+package sqleng
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// warmupCatalog is the in-memory database attached to every database generation to hold the tables of the
+// warm-up queries. Attached databases are shared by the connections of a generation and dropped with it.
+const warmupCatalog = "warmup"
+
+// warmupTableRegex matches the start of a CREATE TEMP TABLE statement up to the table name
+var warmupTableRegex = regexp.MustCompile(`(?is)^\s*CREATE\s+(OR\s+REPLACE\s+)?(?:TEMP|TEMPORARY)\s+TABLE\s+(IF\s+NOT\s+EXISTS\s+)?`)
+
+// warmupResult is the outcome of the warm-up of the current database generation, reported by the health check
+type warmupResult struct {
+	finished time.Time
+	duration time.Duration
+	err      error
+}
+
+func validateWarmupQueries(queries []string) error {
+	for _, query := range queries {
+		if !warmupTableRegex.MatchString(query) {
+			return fmt.Errorf("warm-up query %q is not a CREATE TEMP TABLE … AS SELECT … statement", query)
+		}
+	}
+	return nil
+}
+
+// warmupStatement creates the temporary table of a warm-up query in the warmup catalog instead. Temporary tables
+// only exist on the connection that created them.
+func warmupStatement(query string) string {
+	return warmupTableRegex.ReplaceAllString(query, "CREATE ${1}TABLE ${2}"+warmupCatalog+".")
+}
+
+// attachWarmupCatalog attaches the warmup catalog on a new connection and puts it on the search path after the
+// database file, so that queries find the warm-up tables by their name
+func attachWarmupCatalog(execer driver.ExecerContext) error {
+	ctx := context.Background()
+	// the database itself is read-only, the in-memory one must be opened for writing explicitly
+	if _, err := execer.ExecContext(ctx, "ATTACH IF NOT EXISTS ':memory:' AS "+warmupCatalog+" (READ_WRITE)", nil); err != nil {
+		return err
+	}
+
+	queryer, ok := execer.(driver.QueryerContext)
+	if !ok {
+		return fmt.Errorf("the connection cannot look up the current database")
+	}
+	rows, err := queryer.QueryContext(ctx, "SELECT current_database()", nil)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	current := make([]driver.Value, 1)
+	if err := rows.Next(current); err != nil && err != io.EOF {
+		return err
+	}
+	catalog, ok := current[0].(string)
+	if !ok {
+		return fmt.Errorf("the current database is unknown")
+	}
+
+	searchPath := quoteLiteral(quoteIdentifier(catalog) + "," + warmupCatalog)
+	_, err = execer.ExecContext(ctx, "SET search_path = "+searchPath, nil)
+	return err
+}
+
+// warmUp runs the warm-up queries on a database generation before it serves queries
+func (e *DataSourceHandler) warmUp(ctx context.Context, db *sql.DB) *warmupResult {
+	start := time.Now()
+	result := &warmupResult{}
+	for _, query := range e.dsInfo.JsonData.WarmupQueries {
+		if _, err := db.ExecContext(ctx, warmupStatement(query)); err != nil {
+			result.err = fmt.Errorf("warm-up query %q failed: %w", query, err)
+			break
+		}
+	}
+	result.finished = time.Now()
+	result.duration = result.finished.Sub(start)
+	return result
+}
@@ -0,0 +1,84 @@
+package sqleng
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmup(t *testing.T) {
+	t.Run("Should only accept CREATE TEMP TABLE statements", func(t *testing.T) {
+		require.NoError(t, validateWarmupQueries([]string{
+			"CREATE TEMP TABLE a AS SELECT 1",
+			"  create or replace temporary table if not exists b AS SELECT 1",
+		}))
+		require.Error(t, validateWarmupQueries([]string{"DROP TABLE facts"}))
+		require.Error(t, validateWarmupQueries([]string{"CREATE TABLE a AS SELECT 1"}))
+	})
+
+	t.Run("Should create the tables in the warmup catalog", func(t *testing.T) {
+		require.Equal(t, "CREATE TABLE warmup.a AS SELECT 1", warmupStatement("CREATE TEMP TABLE a AS SELECT 1"))
+		require.Equal(t, "CREATE OR REPLACE TABLE warmup.\"b\" AS SELECT 1", warmupStatement("CREATE OR REPLACE TEMPORARY TABLE \"b\" AS SELECT 1"))
+		require.Equal(t, "CREATE TABLE IF NOT EXISTS warmup.c AS SELECT 1", warmupStatement("create temp table IF NOT EXISTS c AS SELECT 1"))
+	})
+
+	t.Run("Should share the warm-up tables between all connections", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{MaxOpenConns: 4, WarmupQueries: []string{
+			"CREATE TEMP TABLE totals AS SELECT kind, sum(value) AS total FROM facts GROUP BY kind",
+		}}, "CREATE TABLE facts AS SELECT range % 3 AS kind, range AS value FROM range(10)")
+
+		conns := make([]*sql.Conn, 4)
+		for i := range conns {
+			conn, err := handler.db.Conn(context.Background())
+			require.NoError(t, err)
+			conns[i] = conn
+
+			var total int64
+			require.NoError(t, conn.QueryRowContext(context.Background(), "SELECT total FROM totals WHERE kind = 0").Scan(&total))
+			require.Equal(t, int64(18), total)
+			var count int64
+			require.NoError(t, conn.QueryRowContext(context.Background(), "SELECT count(*) FROM facts").Scan(&count))
+			require.Equal(t, int64(10), count)
+		}
+		for _, conn := range conns {
+			require.NoError(t, conn.Close())
+		}
+
+		res, err := handler.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusOk, res.Status)
+		require.Contains(t, res.Message, "warm-up took")
+	})
+
+	t.Run("Should not let queries change the warm-up tables", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{WarmupQueries: []string{"CREATE TEMP TABLE agg AS SELECT sum(value) AS total FROM facts"}},
+			"CREATE TABLE facts AS SELECT range AS value FROM range(10)")
+		query := func(rawSQL string) backend.DataResponse {
+			return queryData(t, handler, backend.DataQuery{JSON: []byte(`{"rawSql": "` + rawSQL + `", "format": "table"}`)})
+		}
+
+		require.ErrorContains(t, query("DROP TABLE warmup.agg").Error, "DROP statements are not allowed")
+		require.ErrorContains(t, query("INSERT INTO agg VALUES (0)").Error, "INSERT statements are not allowed")
+		resp := query("SELECT count(*) AS n FROM agg")
+		require.NoError(t, resp.Error)
+		require.Equal(t, int64(1), *resp.Frames[0].Fields[0].At(0).(*int64))
+	})
+
+	t.Run("Should report a failed warm-up in the health check", func(t *testing.T) {
+		handler := newTestHandler(t, JsonData{WarmupQueries: []string{
+			"CREATE TEMP TABLE totals AS SELECT sum(value) FROM missing",
+		}}, "CREATE TABLE facts AS SELECT range AS value FROM range(10)")
+
+		res, err := handler.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusError, res.Status)
+		require.Contains(t, res.Message, "missing")
+
+		var count int64
+		require.NoError(t, handler.db.QueryRow("SELECT count(*) FROM facts").Scan(&count))
+		require.Equal(t, int64(10), count)
+	})
+}
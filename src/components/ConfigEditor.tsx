@@ -34,6 +34,54 @@ export function ConfigEditor(props: Props) {
     onOptionsChange({...options, jsonData: jsonDataOutput})
   }
 
+  const onSnapshotPatternChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const jsonDataOutput = {
+      ...jsonData,
+      snapshotPattern: event.target.value,
+    }
+    onOptionsChange({...options, jsonData: jsonDataOutput})
+  }
+
+  const onSnapshotRetentionChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const jsonDataOutput = {
+      ...jsonData,
+      snapshotRetention: event.target.value ? Number(event.target.value) : undefined,
+    }
+    onOptionsChange({...options, jsonData: jsonDataOutput})
+  }
+
+  const onSnapshotMinAgeChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const jsonDataOutput = {
+      ...jsonData,
+      snapshotMinAge: event.target.value,
+    }
+    onOptionsChange({...options, jsonData: jsonDataOutput})
+  }
+
+  const onProbeQueryChange = (event: ChangeEvent<HTMLTextAreaElement>) => {
+    const jsonDataOutput = {
+      ...jsonData,
+      probeQuery: event.target.value,
+    }
+    onOptionsChange({...options, jsonData: jsonDataOutput})
+  }
+
+  const onProbeMinRowsChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const jsonDataOutput = {
+      ...jsonData,
+      probeMinRows: event.target.value ? Number(event.target.value) : undefined,
+    }
+    onOptionsChange({...options, jsonData: jsonDataOutput})
+  }
+
+  const onProbeMaxAgeChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const jsonDataOutput = {
+      ...jsonData,
+      probeMaxAge: event.target.value,
+    }
+    onOptionsChange({...options, jsonData: jsonDataOutput})
+  }
+
   return (
       <>
         <InlineField label="Path" labelWidth={14} interactive
@@ -63,6 +111,64 @@ export function ConfigEditor(props: Props) {
             style={{marginTop: 'auto', marginBottom: 'auto'}}
         />
         </InlineField>
+        <InlineField label="Snapshot Pattern" labelWidth={22} interactive
+                     tooltip={'(Optional) When the path is a directory, the snapshot files it serves, "*.duckdb" by default. The newest is served, ordered by the timestamp in its name (e.g. sales-2026-10-17T06.duckdb) or else by modification time. A query is pinned to an older one with snapshot or $__snapshot(\'name\')'}>
+          <Input
+              className="width-30"
+              value={jsonData.snapshotPattern || ''}
+              onChange={onSnapshotPatternChange}
+              placeholder="*.duckdb"
+          />
+        </InlineField>
+        <InlineField label="Snapshot Retention" labelWidth={22} interactive
+                     tooltip={'(Optional) The number of the newest snapshots kept open for pinned queries, 1 by default. When no new snapshot opens, the retained ones keep serving and the data source is reported stale'}>
+          <Input
+              className="width-30"
+              type="number"
+              min={1}
+              value={jsonData.snapshotRetention ?? ''}
+              onChange={onSnapshotRetentionChange}
+              placeholder="1"
+          />
+        </InlineField>
+        <InlineField label="Snapshot Min Age" labelWidth={22} interactive
+                     tooltip={'(Optional) Skip snapshots modified more recently than this, e.g. 30s, as they may still be written'}>
+          <Input
+              className="width-30"
+              value={jsonData.snapshotMinAge || ''}
+              onChange={onSnapshotMinAgeChange}
+              placeholder="30s"
+          />
+        </InlineField>
+        <InlineField label="Probe Query" labelWidth={22} interactive
+                     tooltip={'(Optional) SQL run on every new database file before it is swapped in, e.g. SELECT count(*), max(ts) FROM facts; a false boolean column fails the probe. A file that fails is tried again with a backoff (1s up to 5m) or when it is modified, while the previous one keeps serving with a warning'}>
+          <TextArea
+              className="width-30"
+              value={jsonData.probeQuery || ''}
+              onChange={onProbeQueryChange}
+              placeholder="SELECT count(*), max(ts) FROM facts"
+              rows={3}
+          />
+        </InlineField>
+        <InlineField label="Probe Min Rows" labelWidth={22} interactive
+                     tooltip={'(Optional) The least value of the first integer column of the probe query'}>
+          <Input
+              className="width-30"
+              type="number"
+              min={0}
+              value={jsonData.probeMinRows ?? ''}
+              onChange={onProbeMinRowsChange}
+          />
+        </InlineField>
+        <InlineField label="Probe Max Age" labelWidth={22} interactive
+                     tooltip={'(Optional) The oldest the first time column of the probe query may be, e.g. 2h'}>
+          <Input
+              className="width-30"
+              value={jsonData.probeMaxAge || ''}
+              onChange={onProbeMaxAgeChange}
+              placeholder="2h"
+          />
+        </InlineField>
       </>
   );
 }
@@ -1,5 +1,7 @@
 import {
+  AdHocVariableFilter,
   CoreApp, DataFrame, DataFrameView,
+  DataSourceGetTagValuesOptions,
   DataQueryRequest,
   DataQueryResponse,
   DataSourceInstanceSettings,
@@ -183,7 +185,13 @@ export class DuckDbDatasource extends DataSourceWithBackend<DuckDbQuery, DuckDbO
     */
     this.preconfiguredDatabase = settingsData.database ?? '';
     this.annotations = {
-      prepareAnnotation: migrateAnnotation,
+      prepareAnnotation: (json: any) => {
+        const annotation = migrateAnnotation(json);
+        if (annotation.target) {
+          annotation.target.queryType = 'annotation';
+        }
+        return annotation;
+      },
       QueryEditor: SqlQueryEditor,
     };
   }
@@ -324,15 +332,27 @@ export class DuckDbDatasource extends DataSourceWithBackend<DuckDbQuery, DuckDbO
     return !query.hide;
   }
 
-  applyTemplateVariables(target: DuckDbQuery, scopedVars: ScopedVars) {
+  applyTemplateVariables(target: DuckDbQuery, scopedVars: ScopedVars, filters?: AdHocVariableFilter[]) {
+    // the remaining query options (query type, explain, ...) are passed through to the backend untouched
     return {
+      ...target,
       refId: target.refId,
       datasource: this.getRef(),
       rawSql: this.templateSrv.replace(target.rawSql, scopedVars, this.interpolateVariable),
       format: target.format,
+      adhocFilters: filters ?? [],
     };
   }
 
+  async getTagKeys(): Promise<MetricFindValue[]> {
+    const keys: Array<{ text: string }> = await this.getResource('tag-keys');
+    return keys.map((key) => ({ text: key.text }));
+  }
+
+  async getTagValues(options: DataSourceGetTagValuesOptions<DuckDbQuery>): Promise<MetricFindValue[]> {
+    return this.getResource('tag-values', { key: options.key });
+  }
+
   query(request: DataQueryRequest<DuckDbQuery>): Observable<DataQueryResponse> {
     // This logic reenables the previous SQL behavior regarding what databases are available for the user to query.
     if (isSqlDatasourceDatabaseSelectionFeatureFlagEnabled()) {
@@ -412,6 +432,7 @@ export class DuckDbDatasource extends DataSourceWithBackend<DuckDbQuery, DuckDbO
     const interpolatedQuery: DuckDbQuery = {
       refId: refId,
       datasource: this.getRef(),
+      queryType: 'variable',
       rawSql,
       format: QueryFormat.Table,
     };
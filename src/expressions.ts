@@ -52,6 +52,8 @@ export type QueryEditorExpression =
 export interface QueryEditorGroupByExpression {
     type: QueryEditorExpressionType.GroupBy;
     property: QueryEditorProperty;
+    /** buckets the time column, e.g. '1h' or 'auto' for the panel interval */
+    interval?: string;
 }
 
 export interface QueryEditorFunctionExpression {
@@ -27,6 +27,12 @@ export interface DataSourceResponse {
 export interface DuckDbOptions extends SQLOptions {
   preSql: string;
   reloadAutomatically: boolean;
+  snapshotPattern?: string;
+  snapshotRetention?: number;
+  snapshotMinAge?: string;
+  probeQuery?: string;
+  probeMinRows?: number;
+  probeMaxAge?: string;
   // tlsAuth: boolean;
   // tlsAuthWithCACert: boolean;
   // timezone: string;
@@ -102,6 +108,8 @@ export interface SQLConnectionLimits {
 export enum QueryFormat {
   Timeseries = 'time_series',
   Table = 'table',
+  Logs = 'logs',
+  Heatmap = 'heatmap',
 }
 
 export interface SQLQuery extends DataQuery {
@@ -113,6 +121,25 @@ export interface SQLQuery extends DataQuery {
   sql?: SQLExpression;
   editorMode?: EditorMode;
   rawQuery?: boolean;
+  /** returns one frame per distinct value of this column */
+  splitBy?: string;
+  /** 'long' returns time series as timeseries-long frames, one row per time and series */
+  seriesShape?: 'wide' | 'long';
+  /** series name template, e.g. '{{service}} @ {{region}}' */
+  legendFormat?: string;
+  /** fills missing points of time series, every fillInterval seconds or the query interval */
+  fill?: boolean;
+  fillMode?: 'null' | 'previous' | 'value' | 'linear' | 'zero-after-last';
+  fillValue?: number;
+  fillInterval?: number;
+  /** reduces time series to the max data points of the panel */
+  downsample?: 'minmax' | 'lttb';
+  /** runs the query on an earlier range, e.g. '7d', and moves the result onto the panel's range */
+  timeShift?: string;
+  /** splits the time range into this many parts that run at once */
+  chunks?: number;
+  /** pins the query to a snapshot of a database directory, e.g. 'sales-2026-10-17T06' */
+  snapshot?: string;
 }
 
 export interface NameValue {
@@ -122,10 +149,18 @@ export interface NameValue {
 
 export type SQLFilters = NameValue[];
 
+export interface SQLWhereFilter {
+  column: string;
+  operator: string;
+  value?: string | number | boolean | Array<string | number>;
+}
+
 export interface SQLExpression {
   columns?: QueryEditorFunctionExpression[];
   whereJsonTree?: JsonTree;
   whereString?: string;
+  /** structured conditions, compiled and validated by the backend */
+  whereFilters?: SQLWhereFilter[];
   filters?: SQLFilters;
   groupBy?: QueryEditorGroupByExpression[];
   orderBy?: QueryEditorPropertyExpression;
@@ -157,6 +192,8 @@ export interface QueryRowFilter {
 export const QUERY_FORMAT_OPTIONS = [
   { label: 'Time series', value: QueryFormat.Timeseries },
   { label: 'Table', value: QueryFormat.Table },
+  { label: 'Logs', value: QueryFormat.Logs },
+  { label: 'Heatmap', value: QueryFormat.Heatmap },
 ];
 
 const backWardToOption = (value: string) => ({ label: value, value });